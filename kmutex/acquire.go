@@ -0,0 +1,142 @@
+package kmutex
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gprossliner/xhdl"
+	"k8s.io/klog/v2"
+)
+
+// WaitStatus is the state of the lease while waiting in Acquire
+type WaitStatus struct {
+	// Owners are the current holders of the lease
+	Owners []string
+
+	// Position is our position in the queue of waiters, starting with 1
+	Position int
+
+	// Waiting is the number of waiters in the queue
+	Waiting int
+
+	// NotReady is the error of Kmutex.Ready, if we would have been granted the
+	// lease but are not ready to hold it, nil otherwise
+	NotReady error
+}
+
+// WaitFunc is called by Acquire every time the lease could not be acquired
+type WaitFunc func(ctx xhdl.Context, status WaitStatus)
+
+// Acquire blocks until the lease is acquired, and returns the fencing token.
+// Instead of polling, it watches the lock and only tries to acquire it again
+// if the holders or our position in the queue have changed, or our ticket in
+// the queue needs to be refreshed. info is recorded for the holder, see TryAcquire.
+// onWait may be nil. If ctx is done while waiting, we leave the queue.
+func (km *Kmutex) Acquire(ctx xhdl.Context, info HolderInfo, onWait WaitFunc) Token {
+	for {
+		token, acquired, resourceVersion, r, notReady := km.tryAcquire(ctx, info)
+		if acquired {
+			return token
+		}
+
+		now := km.clock().Now()
+		status := WaitStatus{
+			Owners:   r.owners(now),
+			Position: r.ticket(km.HolderIdentity) + 1,
+			Waiting:  len(r.queue),
+			NotReady: notReady,
+		}
+
+		if onWait != nil {
+			onWait(ctx, status)
+		}
+
+		km.waitForChange(ctx, resourceVersion, status, km.waitTimeout(r, now))
+
+		if ctx.Err() != nil {
+			leaveQueueAfterCancel(ctx, km)
+			ctx.Throw(ctx.Err())
+		}
+	}
+}
+
+// LeaveQueue removes our ticket from the queue of waiters, if we stop
+// trying to acquire the lease. Otherwise it is evicted after TicketTimeout.
+func (km *Kmutex) LeaveQueue(ctx xhdl.Context) {
+	km.withRecord(ctx, func(ctx xhdl.Context, r *record) bool {
+		r.dequeue(km.HolderIdentity)
+		return true
+	})
+}
+
+// leaveQueueAfterCancel calls LeaveQueue of the locker with a context
+// that is not canceled with ctx
+func leaveQueueAfterCancel(ctx context.Context, l Locker) {
+	if err := runWithoutCancel(ctx, l.LeaveQueue); err != nil {
+		klog.Warningf("failed to leave queue: %v", err)
+	}
+}
+
+// runWithoutCancel runs fn with a context that is not canceled with ctx, but
+// times out, to clean up after ctx has been canceled
+func runWithoutCancel(ctx context.Context, fn func(ctx xhdl.Context)) error {
+	cctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+
+	return xhdl.RunContext(cctx, fn)
+}
+
+// waitTimeout returns the time to wait at most before trying again, which
+// is the time our ticket needs to be refreshed, or the next holder expires
+func (km *Kmutex) waitTimeout(r *record, now time.Time) time.Duration {
+	timeout := km.ticketTimeout() / 3
+
+	if r.leaseDuration > 0 {
+		for _, h := range r.holders {
+			expires := h.RenewTime.Add(r.leaseDuration).Sub(now) + time.Second
+			if expires < timeout {
+				timeout = expires
+			}
+		}
+	}
+
+	return timeout
+}
+
+// waitForChange watches the record starting from version, and returns
+// if the owners or our position differ from status, or after timeout
+func (km *Kmutex) waitForChange(ctx xhdl.Context, version string, status WaitStatus, timeout time.Duration) {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	timer := km.clock().NewTimer(timeout)
+	defer timer.Stop()
+
+	go func() {
+		select {
+		case <-timer.C():
+			cancel()
+		case <-wctx.Done():
+		}
+	}()
+
+	records, err := km.backend().watch(wctx, version)
+
+	// without watch we fall back to polling
+	if err != nil {
+		klog.Warningf("failed to watch %v: %v", km.backend(), err)
+		<-wctx.Done()
+		return
+	}
+
+	for r := range records {
+
+		// renewals of the holders don't change anything for us
+		if strings.Join(r.owners(km.clock().Now()), ",") == strings.Join(status.Owners, ",") && r.ticket(km.HolderIdentity)+1 == status.Position {
+			continue
+		}
+
+		return
+	}
+}
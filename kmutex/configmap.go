@@ -0,0 +1,165 @@
+package kmutex
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gprossliner/xhdl"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	annotationTransitions   = annotationPrefix + "transitions"
+	annotationLeaseDuration = annotationPrefix + "leaseDurationSeconds"
+)
+
+// configMapBackend stores the record in the annotations of a ConfigMap,
+// for clusters where Leases can't be used
+type configMapBackend struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewConfigMapBackend returns a Backend storing the lock in the annotations of a ConfigMap
+func NewConfigMapBackend(clientset kubernetes.Interface, namespace, name string) Backend {
+	return configMapBackend{clientset, namespace, name}
+}
+
+func (b configMapBackend) String() string {
+	return fmt.Sprintf("configmap %v/%v", b.namespace, b.name)
+}
+
+func (b configMapBackend) get(ctx xhdl.Context) *record {
+	cm, err := b.clientset.CoreV1().ConfigMaps(b.namespace).Get(ctx, b.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return &record{}
+	}
+	ctx.Throw(err)
+
+	r, err := decodeConfigMap(cm)
+	ctx.Throw(err)
+	return r
+}
+
+func (b configMapBackend) load(ctx xhdl.Context, create bool) *record {
+	ci := b.clientset.CoreV1().ConfigMaps(b.namespace)
+
+	cm, err := ci.Get(ctx, b.name, metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			ctx.Throw(err)
+		}
+
+		if !create {
+			ctx.Throw(fmt.Errorf("%v: %w", b, ErrLeaseMissing))
+		}
+
+		klog.Infof("%v not found, creating", b)
+
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      b.name,
+				Namespace: b.namespace,
+			},
+		}
+
+		cm, err = ci.Create(ctx, cm, metav1.CreateOptions{})
+		ctx.Throw(err)
+	}
+
+	r, err := decodeConfigMap(cm)
+	ctx.Throw(err)
+	return r
+}
+
+func (b configMapBackend) save(ctx xhdl.Context, r *record) (string, error) {
+	cm := r.object.(*corev1.ConfigMap).DeepCopy()
+	if err := encodeConfigMap(cm, r); err != nil {
+		return "", err
+	}
+
+	updated, err := b.clientset.CoreV1().ConfigMaps(b.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	return updated.ResourceVersion, nil
+}
+
+func (b configMapBackend) watch(ctx context.Context, version string) (<-chan *record, error) {
+	w, err := b.clientset.CoreV1().ConfigMaps(b.namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", b.name).String(),
+		ResourceVersion: version,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return watchRecords(ctx, w, func(obj any) (*record, bool) {
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok || cm.Name != b.name {
+			return nil, false
+		}
+
+		r, err := decodeConfigMap(cm)
+		return r, err == nil
+	}), nil
+}
+
+func decodeConfigMap(cm *corev1.ConfigMap) (*record, error) {
+	r := &record{
+		version: cm.ResourceVersion,
+		object:  cm,
+	}
+
+	if err := r.decodeAnnotations(cm.Annotations); err != nil {
+		return nil, fmt.Errorf("configmap %s/%s: %w", cm.Namespace, cm.Name, err)
+	}
+
+	if v, found := cm.Annotations[annotationTransitions]; found {
+		transitions, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("configmap %s/%s: invalid annotation %s: %w", cm.Namespace, cm.Name, annotationTransitions, err)
+		}
+		r.transitions = int32(transitions)
+	}
+
+	if v, found := cm.Annotations[annotationLeaseDuration]; found {
+		seconds, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("configmap %s/%s: invalid annotation %s: %w", cm.Namespace, cm.Name, annotationLeaseDuration, err)
+		}
+		r.leaseDuration = time.Duration(seconds) * time.Second
+	}
+
+	return r, nil
+}
+
+func encodeConfigMap(cm *corev1.ConfigMap, r *record) error {
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+
+	if err := r.encodeAnnotations(cm.Annotations); err != nil {
+		return err
+	}
+
+	cm.Annotations[annotationTransitions] = strconv.FormatInt(int64(r.transitions), 10)
+
+	if r.leaseDuration > 0 {
+		seconds := int64((r.leaseDuration + time.Second - 1) / time.Second)
+		cm.Annotations[annotationLeaseDuration] = strconv.FormatInt(seconds, 10)
+	} else {
+		delete(cm.Annotations, annotationLeaseDuration)
+	}
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package kmutex
+
+import "errors"
+
+var (
+	// ErrNotHolder is returned if the lock is released by an identity not holding it
+	ErrNotHolder = errors.New("lock not held")
+
+	// ErrStaleToken is returned if the lock is released with the fencing token
+	// of a hold that has been lost, while it is held again by our identity
+	ErrStaleToken = errors.New("stale fencing token")
+
+	// ErrUnknownSession is returned if a session is released that doesn't hold the lock
+	ErrUnknownSession = errors.New("unknown session")
+
+	// ErrLeaseMissing is returned if the lock doesn't exist, and
+	// DontCreateLeaseIfNotExists is set
+	ErrLeaseMissing = errors.New("lease does not exist")
+
+	// ErrConflictRetriesExhausted is returned if the lock could not be
+	// updated within MaxConflictRetries, because it was modified concurrently
+	ErrConflictRetriesExhausted = errors.New("conflict retries exhausted")
+)
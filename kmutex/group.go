@@ -0,0 +1,405 @@
+package kmutex
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gprossliner/xhdl"
+	"k8s.io/klog/v2"
+)
+
+// Group is a set of locks, which are acquired and released as a unit.
+// The locks are always acquired in a canonical order, and if one of them
+// can't be acquired, the ones acquired so far are released again before
+// waiting, so groups with overlapping locks never deadlock. Exclusive locks
+// keep our place at the head of their queue, so we aren't starved by shared
+// holders, and the queues of the locks after the one waited for are left.
+//
+// The first lock is the primary lock of the group. The fencing token,
+// the owners, the queue position and the description of the group are
+// those of the primary lock.
+type Group struct {
+	Locks []*Kmutex
+
+	mu         sync.Mutex
+	stopWatch  chan struct{}
+	lost       chan struct{}
+	lostReason error
+}
+
+var _ Locker = &Group{}
+
+// NewGroup returns a Group of the locks, the first is the primary lock
+func NewGroup(locks ...*Kmutex) *Group {
+	return &Group{Locks: locks}
+}
+
+// AcquireAll blocks until all locks are acquired, and returns them as a
+// Group to release them as a unit, and the fencing token of the first lock.
+// See Group.Acquire.
+func AcquireAll(ctx xhdl.Context, info HolderInfo, onWait WaitFunc, locks ...*Kmutex) (*Group, Token) {
+	g := NewGroup(locks...)
+	token := g.Acquire(ctx, info, onWait)
+	return g, token
+}
+
+func (g *Group) primary() *Kmutex {
+	if len(g.Locks) == 0 {
+		panic("group without locks")
+	}
+
+	return g.Locks[0]
+}
+
+// ordered returns the locks in the canonical order of acquisition
+func (g *Group) ordered() []*Kmutex {
+	locks := slices.Clone(g.Locks)
+	slices.SortStableFunc(locks, func(a, b *Kmutex) int {
+		return strings.Compare(a.backend().String(), b.backend().String())
+	})
+
+	return locks
+}
+
+// holds returns true if the lock is held by our identity
+func holds(ctx xhdl.Context, km *Kmutex) bool {
+	return slices.Contains(km.CurrentOwners(ctx), km.HolderIdentity)
+}
+
+// TryAcquire tries to acquire all locks, and returns true if all are held by us.
+// If one of the locks can't be acquired, the locks acquired by this call are
+// released again. See Kmutex.TryAcquire.
+func (g *Group) TryAcquire(ctx xhdl.Context, info HolderInfo) (token Token, acquired bool) {
+	token, acquired, _, _, _, _ = g.tryAcquire(ctx, info)
+	return
+}
+
+// tryAcquire is TryAcquire, also returning the lock that couldn't be acquired,
+// with the resourceVersion, the record and the error of Ready of it
+func (g *Group) tryAcquire(ctx xhdl.Context, info HolderInfo) (token Token, acquired bool, failed *Kmutex, resourceVersion string, rec *record, notReady error) {
+	var newly []*Kmutex
+
+	err := xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		for _, km := range g.ordered() {
+			held := holds(ctx, km)
+
+			var ok bool
+			_, ok, resourceVersion, rec, notReady = km.tryAcquire(ctx, info)
+			if !ok {
+				failed = km
+				return
+			}
+
+			if !held {
+				newly = append(newly, km)
+			}
+		}
+	})
+
+	if err != nil {
+		g.releaseAll(ctx, newly, "")
+		g.leaveQueues(ctx, nil)
+		ctx.Throw(err)
+	}
+
+	// back off, we don't keep some of the locks while waiting for the others,
+	// only our place in the queues of the exclusive ones before the one waited
+	// for. A place in the queues after it would block the groups waiting for
+	// them in the canonical order, and in the queues of shared locks others.
+	if failed != nil {
+		g.backOffAll(ctx, newly)
+		g.leaveQueues(ctx, failed)
+		return 0, false, failed, resourceVersion, rec, notReady
+	}
+
+	g.startWatch()
+
+	g.primary().mu.Lock()
+	token = g.primary().token
+	g.primary().mu.Unlock()
+
+	return token, true, nil, "", nil, nil
+}
+
+// Acquire blocks until all locks are acquired, and returns the fencing token of
+// the primary lock. If one of the locks can't be acquired, the others are released,
+// and Acquire waits for this lock to change before trying again. onWait is
+// called with the status of this lock, and may be nil. See Kmutex.Acquire.
+func (g *Group) Acquire(ctx xhdl.Context, info HolderInfo, onWait WaitFunc) Token {
+	for {
+		token, acquired, km, resourceVersion, r, notReady := g.tryAcquire(ctx, info)
+		if acquired {
+			return token
+		}
+
+		now := km.clock().Now()
+		status := WaitStatus{
+			Owners:   r.owners(now),
+			Position: r.ticket(km.HolderIdentity) + 1,
+			Waiting:  len(r.queue),
+			NotReady: notReady,
+		}
+
+		if onWait != nil {
+			onWait(ctx, status)
+		}
+
+		km.waitForChange(ctx, resourceVersion, status, km.waitTimeout(r, now))
+
+		if ctx.Err() != nil {
+			leaveQueueAfterCancel(ctx, g)
+			ctx.Throw(ctx.Err())
+		}
+	}
+}
+
+// LeaveQueue leaves the queues of all locks, see Kmutex.LeaveQueue
+func (g *Group) LeaveQueue(ctx xhdl.Context) {
+	for _, km := range g.ordered() {
+		km.LeaveQueue(ctx)
+	}
+}
+
+// leaveQueues leaves the queues of all locks except the one waited for, and
+// the exclusive ones before it in the canonical order, see backOff. All locks
+// are left if waited is nil, and all queues also if some of them fail or ctx
+// has been canceled.
+func (g *Group) leaveQueues(ctx xhdl.Context, waited *Kmutex) {
+	locks := g.ordered()
+	before := slices.Index(locks, waited)
+
+	var errs []error
+	for i, km := range locks {
+		if i == before || (i < before && km.Exclusive) {
+			continue
+		}
+
+		if err := runWithoutCancel(ctx, km.LeaveQueue); err != nil {
+			klog.Warningf("failed to leave queue of %v: %v", km.backend(), err)
+			errs = append(errs, err)
+		}
+	}
+
+	ctx.Throw(errors.Join(errs...))
+}
+
+// releaseAll releases the session of the locks in reverse order, or the locks if
+// session is empty. All locks are released, also if some of them fail or ctx has
+// been canceled, and true is returned if the locks are still held by other sessions.
+func (g *Group) releaseAll(ctx xhdl.Context, locks []*Kmutex, session string) (held bool) {
+	var errs []error
+	for i := len(locks) - 1; i >= 0; i-- {
+		km := locks[i]
+		err := runWithoutCancel(ctx, func(ctx xhdl.Context) {
+			if km.ReleaseSession(ctx, session) {
+				held = true
+			}
+		})
+
+		if err != nil {
+			klog.Warningf("failed to release %v: %v", km.backend(), err)
+			errs = append(errs, err)
+		}
+	}
+
+	ctx.Throw(errors.Join(errs...))
+	return
+}
+
+// backOffAll releases the locks in reverse order, keeping our place in the queues
+// of the exclusive ones. All locks are released, also if some of them fail or ctx
+// has been canceled.
+func (g *Group) backOffAll(ctx xhdl.Context, locks []*Kmutex) {
+	var errs []error
+	for i := len(locks) - 1; i >= 0; i-- {
+		if err := runWithoutCancel(ctx, locks[i].backOff); err != nil {
+			klog.Warningf("failed to release %v: %v", locks[i].backend(), err)
+			errs = append(errs, err)
+		}
+	}
+
+	ctx.Throw(errors.Join(errs...))
+}
+
+// Release releases all locks, see Kmutex.Release
+func (g *Group) Release(ctx xhdl.Context) {
+	defer g.stopWatching()
+	g.releaseAll(ctx, g.ordered(), "")
+}
+
+// ReleaseSession releases the session of all locks, see Kmutex.ReleaseSession
+func (g *Group) ReleaseSession(ctx xhdl.Context, session string) (held bool) {
+	held = g.releaseAll(ctx, g.ordered(), session)
+	if !held {
+		g.stopWatching()
+	}
+
+	return
+}
+
+// RefreshSession refreshes the session on all locks, see Kmutex.RefreshSession
+func (g *Group) RefreshSession(ctx xhdl.Context, session string) {
+	for _, km := range g.ordered() {
+		km.RefreshSession(ctx, session)
+	}
+}
+
+// ForceRelease releases the hold of identity on all locks, and returns the holder
+// of the primary lock. See Kmutex.ForceRelease.
+func (g *Group) ForceRelease(ctx xhdl.Context, identity, reason string) (removed Holder, released bool) {
+	for _, km := range g.ordered() {
+		h, ok := km.ForceRelease(ctx, identity, reason)
+		if ok && (!released || km == g.primary()) {
+			removed = h
+		}
+		released = released || ok
+	}
+
+	return
+}
+
+// TakeOver takes the hold of identity over on all locks, and returns the holder
+// of the primary lock. See Kmutex.TakeOver.
+func (g *Group) TakeOver(ctx xhdl.Context, identity, reason string) (previous Holder, taken bool) {
+	for _, km := range g.ordered() {
+		h, ok := km.TakeOver(ctx, identity, reason)
+		if ok && (!taken || km == g.primary()) {
+			previous = h
+		}
+		taken = taken || ok
+	}
+
+	if taken {
+		g.startWatch()
+	}
+
+	return
+}
+
+// Extend extends the deadline of all locks, and returns the deadline of the
+// primary lock. See Kmutex.Extend.
+func (g *Group) Extend(ctx xhdl.Context, d time.Duration, reason string) (deadline time.Time) {
+	for _, km := range g.ordered() {
+		t := km.Extend(ctx, d, reason)
+		if km == g.primary() {
+			deadline = t
+		}
+	}
+
+	return
+}
+
+// CheckToken returns true if the primary lock is held with the token,
+// and the other locks are held by us
+func (g *Group) CheckToken(ctx xhdl.Context, token Token) bool {
+	if !g.primary().CheckToken(ctx, token) {
+		return false
+	}
+
+	for _, km := range g.Locks[1:] {
+		if !holds(ctx, km) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CurrentOwner returns the holder of the primary lock
+func (g *Group) CurrentOwner(ctx xhdl.Context) string {
+	return g.primary().CurrentOwner(ctx)
+}
+
+// CurrentOwners returns the holders of the primary lock
+func (g *Group) CurrentOwners(ctx xhdl.Context) []string {
+	return g.primary().CurrentOwners(ctx)
+}
+
+// QueuePosition returns the position in the queue of the primary lock
+func (g *Group) QueuePosition(ctx xhdl.Context) (position int, waiting int) {
+	return g.primary().QueuePosition(ctx)
+}
+
+// Describe returns the state of the primary lock
+func (g *Group) Describe(ctx xhdl.Context) Description {
+	return g.primary().Describe(ctx)
+}
+
+// Lost returns a channel that is closed if any of the locks is lost, see Kmutex.Lost
+func (g *Group) Lost() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.lost == nil {
+		g.lost = make(chan struct{})
+	}
+
+	return g.lost
+}
+
+// LostReason returns why a lock has been lost, nil if not lost
+func (g *Group) LostReason() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.lostReason
+}
+
+// startWatch starts watching the locks for being lost, if not already running
+func (g *Group) startWatch() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stopWatch != nil {
+		return
+	}
+
+	// a new hold gets a new lost channel, if the last one has fired
+	if g.lost == nil || g.lostReason != nil {
+		g.lost = make(chan struct{})
+		g.lostReason = nil
+	}
+
+	g.stopWatch = make(chan struct{})
+	go g.watchLost(g.stopWatch, g.lost)
+}
+
+func (g *Group) stopWatching() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stopWatch != nil {
+		close(g.stopWatch)
+		g.stopWatch = nil
+	}
+}
+
+// watchLost closes lost if any of the locks is lost, until stop is closed
+func (g *Group) watchLost(stop, lost chan struct{}) {
+	cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stop)}}
+	for _, km := range g.Locks {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(km.Lost())})
+	}
+
+	chosen, _, _ := reflect.Select(cases)
+	if chosen == 0 {
+		return
+	}
+
+	km := g.Locks[chosen-1]
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.lostReason = fmt.Errorf("%v: %w", km.backend(), km.LostReason())
+	close(lost)
+
+	if g.stopWatch == stop {
+		g.stopWatch = nil
+	}
+}
@@ -1,17 +1,23 @@
 package kmutex
 
 import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gprossliner/xhdl"
-	coordinationv1 "k8s.io/api/coordination/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 
 	"k8s.io/client-go/kubernetes"
 )
 
+// Kmutex is a lock stored in a Backend, by default in a Lease
 type Kmutex struct {
 	LeaseName                  string
 	LeaseNamespace             string
@@ -19,110 +25,782 @@ type Kmutex struct {
 	DontCreateLeaseIfNotExists bool
 	Clientset                  kubernetes.Interface
 	RetryInterval              time.Duration
+
+	// Backend stores the lock, if nil a Lease named LeaseName in
+	// LeaseNamespace is used
+	Backend Backend
+
+	// LeaseDuration is the time after which a lease that hasn't been renewed
+	// is considered free and may be taken over by another holder.
+	// If 0 the lease never expires.
+	LeaseDuration time.Duration
+
+	// RenewInterval is the interval the holder renews an acquired lease in the
+	// background. Defaults to a third of LeaseDuration.
+	RenewInterval time.Duration
+
+	// MaxHolders is the number of holders that may hold the lease
+	// at the same time. Defaults to 1, which makes it a mutex.
+	MaxHolders int
+
+	// MaxHoldersFunc returns the MaxHolders every time we try to acquire the
+	// lease, if the limit changes, e.g. with the size of a pool of nodes.
+	// It replaces MaxHolders if set.
+	MaxHoldersFunc func(ctx xhdl.Context) int
+
+	// Exclusive makes us hold the lease exclusively, no matter of MaxHolders.
+	// An exclusive holder waits for all other holders to release the lease,
+	// and others wait for the exclusive holder. Waiters queued after an
+	// exclusive waiter are not granted the lease before it.
+	Exclusive bool
+
+	// Domain is the topology domain of the holder, e.g. its zone or rack. If set,
+	// the lease is held by at most one holder of the domain at the same time.
+	// Waiters of a domain already held are skipped in the queue, so the other
+	// domains don't wait for them.
+	Domain string
+
+	// MaxHoldDuration sets the deadline of a hold, after which it is overdue,
+	// unless it is extended by Extend. The lease is not released when the
+	// hold is overdue, it is up to the users to act on it. 0 for no deadline.
+	MaxHoldDuration time.Duration
+
+	// SessionTimeout is the time after which a session expires, that has not been
+	// refreshed by TryAcquire or RefreshSession. The hold is released when its last
+	// session expires, so a crashed client doesn't hold the lease forever.
+	// 0 for sessions that don't expire.
+	SessionTimeout time.Duration
+
+	// Ready is called before the lease is granted to us, and may be nil. If it
+	// returns an error, we are not ready to hold the lease, e.g. because a
+	// precondition of the update is not met. We keep our place in the queue,
+	// and Acquire tries again until we are ready. See WaitStatus.NotReady.
+	Ready func(ctx xhdl.Context) error
+
+	// Clock is used for all timing, defaults to the real clock.
+	// Tests can use a fake clock from k8s.io/utils/clock/testing.
+	Clock clock.WithTicker
+
+	// Observer gets notified about the transitions of the lock, may be nil
+	Observer Observer
+
+	// TicketTimeout is the time after which a waiter in the queue that has not
+	// called TryAcquire again is evicted from the queue. Defaults to one minute.
+	TicketTimeout time.Duration
+
+	// MaxConflictRetries is the number of times an update of the lock is retried
+	// if it has been modified concurrently. Defaults to 10. The retries back off
+	// exponentially, starting with RetryInterval.
+	MaxConflictRetries int
+
+	mu         sync.Mutex
+	token      Token
+	stopRenew  chan struct{}
+	lost       chan struct{}
+	lostReason error
 }
 
-// withLease is a helper for getting the Lease and retry loop
-// if returns ok if the fn succeeded
-func (km Kmutex) withLease(ctx xhdl.Context, fn func(ctx xhdl.Context, lease *coordinationv1.Lease) bool) bool {
-	li := km.Clientset.CoordinationV1().Leases(km.LeaseNamespace)
+func (km *Kmutex) clock() clock.WithTicker {
+	if km.Clock != nil {
+		return km.Clock
+	}
 
-	for {
-		lease, err := li.Get(ctx, km.LeaseName, metav1.GetOptions{})
-		if err != nil {
-			if km.DontCreateLeaseIfNotExists {
-				ctx.Throw(err)
-			}
+	return clock.RealClock{}
+}
 
-			if errors.IsNotFound(err) {
-				klog.Infof("lease %v/%v not found, creating", km.LeaseNamespace, km.LeaseName)
-
-				// the fake.NewSimpleClientset() doesn't create a new instance, like the
-				// real kubernetes.Clientset, so we create it here if it is nil to
-				// make the test work
-				if lease == nil {
-					lease = &coordinationv1.Lease{
-						TypeMeta: metav1.TypeMeta{
-							Kind:       "Lease",
-							APIVersion: "coordination.k8s.io/v1",
-						},
-					}
-				}
+// backend returns the Backend, or the Lease backend if not set
+func (km *Kmutex) backend() Backend {
+	if km.Backend != nil {
+		return km.Backend
+	}
 
-				lease.Name = km.LeaseName
-				lease.Namespace = km.LeaseNamespace
+	return NewLeaseBackend(km.Clientset, km.LeaseNamespace, km.LeaseName)
+}
 
-				lcreated, err := li.Create(ctx, lease, metav1.CreateOptions{})
-				ctx.Throw(err)
-				lease = lcreated
-			}
-		}
+// maxRetryInterval limits the backoff of conflict retries
+const maxRetryInterval = 30 * time.Second
 
-		result := fn(ctx, lease)
+func (km *Kmutex) maxConflictRetries() int {
+	if km.MaxConflictRetries > 0 {
+		return km.MaxConflictRetries
+	}
 
-		// save lease
-		_, err = li.Update(ctx, lease, metav1.UpdateOptions{})
+	return 10
+}
+
+// retryBackoff returns the time to wait before the retry, which doubles with
+// every attempt, starting with RetryInterval. Jitter of up to half of the
+// interval is added, so that concurrent updaters don't retry in lockstep.
+func (km *Kmutex) retryBackoff(retry int) time.Duration {
+	d := km.RetryInterval
+	for i := 0; i < retry && d < maxRetryInterval; i++ {
+		d *= 2
+	}
+
+	d = min(d, maxRetryInterval)
+	if d <= 0 {
+		return 0
+	}
+
+	return d + rand.N(d/2+1)
+}
+
+// sleep waits for d, and throws if ctx is done before
+func (km *Kmutex) sleep(ctx xhdl.Context, d time.Duration) {
+	timer := km.clock().NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		ctx.Throw(ctx.Err())
+	case <-timer.C():
+	}
+}
+
+// withRecord is a helper for loading the record and retry loop
+// if returns ok if the fn succeeded. The record is only saved if changed by fn.
+func (km *Kmutex) withRecord(ctx xhdl.Context, fn func(ctx xhdl.Context, r *record) bool) bool {
+	result, _ := km.withRecordVersion(ctx, fn)
+	return result
+}
+
+// withRecordVersion is withRecord, also returning the version of the record
+// after the operation
+func (km *Kmutex) withRecordVersion(ctx xhdl.Context, fn func(ctx xhdl.Context, r *record) bool) (bool, string) {
+	backend := km.backend()
+
+	for retry := 0; ; retry++ {
+		r := backend.load(ctx, !km.DontCreateLeaseIfNotExists)
+
+		original := r.clone()
+		result := fn(ctx, r)
+
+		// nothing to save
+		if original.equal(r) {
+			return result, r.version
+		}
+
+		// save record
+		version, err := backend.save(ctx, r)
 
 		if err != nil {
 
 			// we retry the operation in case of conflict
-			// because the lease is loaded again, we should be able to resolve this
+			// because the record is loaded again, we should be able to resolve this
 			if !errors.IsConflict(err) {
 				ctx.Throw(err)
-			} else {
-				// if conflict we will stay in retry loop
-				time.Sleep(km.RetryInterval)
-				continue
 			}
+
+			if retry >= km.maxConflictRetries() {
+				ctx.Throw(fmt.Errorf("update of %v failed after %d retries: %w: %w", backend, retry, ErrConflictRetriesExhausted, err))
+			}
+
+			km.observe(func(o Observer, lock string) { o.ConflictRetry(lock, retry+1, err) })
+
+			// if conflict we will stay in retry loop
+			km.sleep(ctx, km.retryBackoff(retry))
+			continue
+		}
+
+		return result, version
+
+	}
+}
+
+// getRecord returns the record of the lock without modifying it.
+func (km *Kmutex) getRecord(ctx xhdl.Context) *record {
+	return km.backend().get(ctx)
+}
+
+func (km *Kmutex) maxHolders(ctx xhdl.Context) int {
+	n := km.MaxHolders
+	if km.MaxHoldersFunc != nil {
+		n = km.MaxHoldersFunc(ctx)
+	}
+
+	if n < 1 {
+		return 1
+	}
+
+	return n
+}
+
+func (km *Kmutex) ticketTimeout() time.Duration {
+	if km.TicketTimeout > 0 {
+		return km.TicketTimeout
+	}
+
+	return time.Minute
+}
+
+// CurrentOwner returns the holder of the lease, or "" if not held.
+// If MaxHolders is used, this is the first of CurrentOwners.
+func (km *Kmutex) CurrentOwner(ctx xhdl.Context) (owner string) {
+	owners := km.CurrentOwners(ctx)
+	if len(owners) == 0 {
+		return ""
+	}
+
+	return owners[0]
+}
+
+// CurrentOwners returns all holders of the lease
+func (km *Kmutex) CurrentOwners(ctx xhdl.Context) (owners []string) {
+	return km.getRecord(ctx).owners(km.clock().Now())
+}
+
+// QueuePosition returns the position of our ticket in the queue of waiters,
+// starting with 1, and the number of waiters. position is 0 if not queued.
+func (km *Kmutex) QueuePosition(ctx xhdl.Context) (position int, waiting int) {
+	r := km.getRecord(ctx)
+	return r.ticket(km.HolderIdentity) + 1, len(r.queue)
+}
+
+// TryAcquire tries to acquire the lease and returns true if it is held by us.
+// Waiters are granted the lease in the order of their first call to TryAcquire,
+// so if the lease is not acquired, we keep our position in the queue by calling
+// TryAcquire again within TicketTimeout.
+// If acquired, the fencing token of the hold is returned. It is the same
+// for every call until the lease is released, and increases with every
+// acquisition. It is based on the LeaseTransitions of the lease.
+// info is recorded for the holder if the lease gets acquired, see Describe.
+// If info.Session is set, the session is added to the sessions of the holder,
+// also if the lease is already held by us, see ReleaseSession.
+// If LeaseDuration is set, the lease is renewed in the background until
+// Release is called, see Lost for how to get notified if this fails.
+func (km *Kmutex) TryAcquire(ctx xhdl.Context, info HolderInfo) (token Token, acquired bool) {
+	token, acquired, _, _, _ = km.tryAcquire(ctx, info)
+	return
+}
+
+// tryAcquire is TryAcquire, also returning the resourceVersion and the record of the lease,
+// and the error of Ready if we would have been granted the lease
+func (km *Kmutex) tryAcquire(ctx xhdl.Context, info HolderInfo) (token Token, acquired bool, resourceVersion string, rec *record, notReady error) {
+	km.observe(func(o Observer, lock string) { o.AcquireAttempt(lock, km.HolderIdentity) })
+
+	// set by the last run of fn, for the observer
+	var expired, sessionsExpired []Holder
+	var granted bool
+	var wait time.Duration
+
+	// Ready and MaxHoldersFunc are only called once, also if fn is retried
+	var readyChecked bool
+	maxHolders := -1
+
+	acquired, resourceVersion = km.withRecordVersion(ctx, func(ctx xhdl.Context, r *record) (retry bool) {
+		rec = r
+		granted = false
+		wait = 0
+
+		now := km.clock().Now()
+		renewTime := metav1.NewMicroTime(now)
+
+		// holders failed to renew it in time are removed
+		expired = r.prune(now)
+		for _, h := range expired {
+			klog.Infof("%v held by %s expired, taking over", km.backend(), h.Identity)
+		}
+
+		// holders whose sessions all expired are removed
+		sessionsExpired = r.pruneSessions(now)
+		for _, h := range sessionsExpired {
+			klog.Infof("sessions of %s on %v expired, releasing it", h.Identity, km.backend())
+		}
+
+		// waiters failed to come back in time are removed
+		for _, t := range r.evict(now, km.ticketTimeout()) {
+			klog.Infof("waiter %s evicted from queue of %v", t.Identity, km.backend())
+		}
+
+		// check if we own, then renew
+		if i := r.holder(km.HolderIdentity); i >= 0 {
+			r.holders[i].RenewTime = renewTime
+			if info.Session != "" {
+				if j := r.holders[i].session(info.Session); j >= 0 {
+					r.holders[i].Sessions[j].RefreshTime = renewTime
+				} else {
+					r.holders[i].Sessions = append(r.holders[i].Sessions, km.newSession(info, renewTime))
+				}
+			}
+			r.leaseDuration = km.LeaseDuration
+			token = r.holders[i].Token
+			return true
+		}
+
+		// only waiters at the head of the queue get a free slot
+		position := r.enqueue(km.HolderIdentity, km.Exclusive, km.Domain, now)
+		slot, blocked := r.slot(position)
+		if maxHolders < 0 {
+			maxHolders = km.maxHolders(ctx)
+		}
+		if blocked || slot >= maxHolders-len(r.holders) {
+			return false
+		}
+
+		// shared holders wait for exclusive holders and waiters before them,
+		// exclusive holders for all other holders
+		if r.exclusive() || r.exclusiveWaiting(position) || (km.Exclusive && len(r.holders) > 0) {
+			return false
+		}
+
+		// not ready, we keep our place for the next try
+		if km.Ready != nil && !readyChecked {
+			notReady = km.Ready(ctx)
+			readyChecked = true
+		}
+		if notReady != nil {
+			return false
+		}
+
+		wait = now.Sub(r.queue[position].EnqueueTime.Time)
+		r.dequeue(km.HolderIdentity)
+		r.transitions++
+		token = Token(r.transitions)
+		h := Holder{
+			Identity:    km.HolderIdentity,
+			Token:       token,
+			AcquireTime: renewTime,
+			RenewTime:   renewTime,
+			HolderInfo:  info,
+			Exclusive:   km.Exclusive,
+			Domain:      km.Domain,
+		}
+		if info.Session != "" {
+			h.Sessions = []Session{km.newSession(info, renewTime)}
+		}
+		if km.MaxHoldDuration > 0 {
+			deadline := metav1.NewMicroTime(now.Add(km.MaxHoldDuration))
+			h.Deadline = &deadline
+		}
+		r.holders = append(r.holders, h)
+		r.leaseDuration = km.LeaseDuration
+		granted = true
+		return true
+	})
+
+	km.observe(func(o Observer, lock string) {
+		for _, h := range expired {
+			o.TakenOver(lock, h, km.HolderIdentity, "expired")
+		}
+
+		for _, h := range sessionsExpired {
+			o.TakenOver(lock, h, km.HolderIdentity, "sessions expired")
+		}
+
+		if granted {
+			o.Acquired(lock, km.HolderIdentity, token, wait)
+		}
+	})
+
+	if acquired {
+		km.mu.Lock()
+		km.token = token
+		km.mu.Unlock()
+
+		if km.LeaseDuration > 0 {
+			km.startRenewal()
+		}
+	}
+
+	return
+}
+
+// newSession returns a new session of info, acquired at now
+func (km *Kmutex) newSession(info HolderInfo, now metav1.MicroTime) Session {
+	return Session{
+		HolderInfo:  info,
+		AcquireTime: now,
+		RefreshTime: now,
+		Timeout:     metav1.Duration{Duration: km.SessionTimeout},
+	}
+}
+
+// RefreshSession refreshes the session of our hold, so that it doesn't expire,
+// see SessionTimeout. It fails with ErrNotHolder if the lease is not held by us,
+// and with ErrUnknownSession if the session doesn't hold it.
+func (km *Kmutex) RefreshSession(ctx xhdl.Context, session string) {
+	km.withRecord(ctx, func(ctx xhdl.Context, r *record) bool {
+		now := km.clock().Now()
+
+		i := r.holder(km.HolderIdentity)
+		if i < 0 || r.expired(r.holders[i], now) {
+			ctx.Throw(fmt.Errorf("refresh of session %s on %v by %s: %w", session, km.backend(), km.HolderIdentity, ErrNotHolder))
+		}
+
+		j := r.holders[i].session(session)
+		if j < 0 || r.holders[i].Sessions[j].Expired(now) {
+			ctx.Throw(fmt.Errorf("refresh of session %s on %v by %s: %w", session, km.backend(), km.HolderIdentity, ErrUnknownSession))
 		}
 
-		return result
+		r.holders[i].Sessions[j].RefreshTime = metav1.NewMicroTime(now)
+		return true
+	})
+}
 
+// Describe returns the state of the lock, including who holds
+// it since when and why
+func (km *Kmutex) Describe(ctx xhdl.Context) Description {
+	r := km.getRecord(ctx)
+	return Description{
+		Backend:          km.backend().String(),
+		Holders:          r.holders,
+		Waiters:          r.queue,
+		LastForceRelease: r.forceRelease,
+		Token:            Token(r.transitions),
+		LeaseDuration:    r.leaseDuration,
 	}
 }
 
-func (km Kmutex) CurrentOwner(ctx xhdl.Context) (owner string) {
+// CheckToken returns true if the lease is held by us with the given fencing token.
+// This is false if the hold of the token has been released, expired or
+// has been taken over in the meantime, even if we acquired it again.
+func (km *Kmutex) CheckToken(ctx xhdl.Context, token Token) bool {
+	r := km.getRecord(ctx)
+	i := r.holder(km.HolderIdentity)
+	return i >= 0 && !r.expired(r.holders[i], km.clock().Now()) && r.holders[i].Token == token
+}
+
+// Release releases the lease, including all sessions. It fails with ErrNotHolder
+// if the lease is held by others, and with ErrStaleToken if it is held by our
+// identity, but with another fencing token than acquired by this instance. This
+// happens if our hold was lost, and the lease has been acquired again by another instance.
+func (km *Kmutex) Release(ctx xhdl.Context) {
+	km.release(ctx, "", false)
+}
 
-	km.withLease(ctx, func(ctx xhdl.Context, lease *coordinationv1.Lease) (retry bool) {
-		if lease.Spec.HolderIdentity == nil {
-			owner = ""
+// ReleaseSession releases the session acquired by TryAcquire. The lease is
+// released if this was the last session, otherwise it is still held and true
+// is returned. It fails with ErrUnknownSession if the session doesn't hold the
+// lease, and like Release otherwise.
+func (km *Kmutex) ReleaseSession(ctx xhdl.Context, session string) (held bool) {
+	return km.release(ctx, session, false)
+}
+
+// backOff releases the lease like Release, while a Group waits for another lock.
+// If Exclusive, our ticket is put at the head of the queue, so we keep our place
+// and shared waiters don't get the lease in the meantime.
+func (km *Kmutex) backOff(ctx xhdl.Context) {
+	km.release(ctx, "", km.Exclusive)
+}
+
+// release releases the session, or the lease if session is empty. With requeue
+// a released lease is queued for again at the head of the queue.
+func (km *Kmutex) release(ctx xhdl.Context, session string, requeue bool) (held bool) {
+	km.mu.Lock()
+	token := km.token
+	km.mu.Unlock()
+
+	var released *Holder
+	km.withRecord(ctx, func(ctx xhdl.Context, r *record) (retry bool) {
+		held = false
+		released = nil
+
+		i := r.holder(km.HolderIdentity)
+		if i < 0 && len(r.owners(km.clock().Now())) > 0 {
+			ctx.Throw(fmt.Errorf("release of %v by %s: %w", km.backend(), km.HolderIdentity, ErrNotHolder))
+		}
+
+		if i >= 0 && token != 0 && r.holders[i].Token != token {
+			ctx.Throw(fmt.Errorf("release of %v with fencing token %d, but held with %d: %w", km.backend(), token, r.holders[i].Token, ErrStaleToken))
+		}
+
+		if i >= 0 && session != "" {
+			j := r.holders[i].session(session)
+			if j < 0 {
+				ctx.Throw(fmt.Errorf("release of %v by %s with session %s: %w", km.backend(), km.HolderIdentity, session, ErrUnknownSession))
+			}
+
+			r.holders[i].Sessions = append(r.holders[i].Sessions[:j], r.holders[i].Sessions[j+1:]...)
+			if len(r.holders[i].Sessions) > 0 {
+				held = true
+				return true
+			}
+		}
+
+		if i >= 0 {
+			h := r.holders[i]
+			released = &h
+			r.holders = append(r.holders[:i], r.holders[i+1:]...)
+		}
+
+		if requeue && released != nil {
+			r.requeue(km.HolderIdentity, km.Exclusive, km.Domain, km.clock().Now())
 		} else {
-			owner = *lease.Spec.HolderIdentity
+			r.dequeue(km.HolderIdentity)
 		}
+		return true
+	})
+
+	if released != nil {
+		km.observe(func(o Observer, lock string) { o.Released(lock, km.HolderIdentity, released.Token) })
+	}
+
+	if held {
+		return
+	}
+
+	km.mu.Lock()
+	km.token = 0
+	km.mu.Unlock()
+
+	km.stopRenewal()
+	return
+}
+
+// Extend extends the deadline of our hold to d from now, and records the reason.
+// It fails with ErrNotHolder if the lease is not held by us.
+func (km *Kmutex) Extend(ctx xhdl.Context, d time.Duration, reason string) (deadline time.Time) {
+	km.withRecord(ctx, func(ctx xhdl.Context, r *record) bool {
+		now := km.clock().Now()
+
+		i := r.holder(km.HolderIdentity)
+		if i < 0 || r.expired(r.holders[i], now) {
+			ctx.Throw(fmt.Errorf("extend of %v by %s: %w", km.backend(), km.HolderIdentity, ErrNotHolder))
+		}
+
+		d := metav1.NewMicroTime(now.Add(d))
+		r.holders[i].Deadline = &d
+		r.holders[i].Extensions = append(r.holders[i].Extensions, Extension{
+			Time:   metav1.NewMicroTime(now),
+			Reason: reason,
+		})
 
-		return false
+		deadline = d.Time
+		return true
 	})
 
+	klog.Infof("hold of %s on %v extended until %v: %s", km.HolderIdentity, km.backend(), deadline, reason)
 	return
 }
 
-func (km Kmutex) TryAcquire(ctx xhdl.Context) bool {
+// ForceRelease releases the hold of another holder, e.g. if it is known to be
+// dead and the lease doesn't expire. Who broke the hold and why is recorded,
+// see Describe. It returns the removed holder, and false if identity didn't hold
+// the lease. The holder will notice on the next renewal, see Lost.
+func (km *Kmutex) ForceRelease(ctx xhdl.Context, identity, reason string) (removed Holder, released bool) {
+	km.withRecord(ctx, func(ctx xhdl.Context, r *record) bool {
+		i := r.holder(identity)
+		released = i >= 0
+		if !released {
+			return false
+		}
 
-	return km.withLease(ctx, func(ctx xhdl.Context, lease *coordinationv1.Lease) (retry bool) {
+		removed = r.holders[i]
+		r.holders = append(r.holders[:i], r.holders[i+1:]...)
+		r.forceRelease = &ForceRelease{
+			Holder: removed,
+			By:     km.HolderIdentity,
+			Reason: reason,
+			Time:   metav1.NewMicroTime(km.clock().Now()),
+		}
 
-		// check if lease not owned
-		if lease.Spec.HolderIdentity == nil {
-			lease.Spec.HolderIdentity = &km.HolderIdentity
-			return true
+		klog.Warningf("hold of %s on %v force released by %s: %s", identity, km.backend(), km.HolderIdentity, reason)
+		return true
+	})
+
+	if released {
+		km.observe(func(o Observer, lock string) { o.TakenOver(lock, removed, km.HolderIdentity, reason) })
+	}
+
+	return
+}
+
+// TakeOver takes the hold of identity over as our own, e.g. if we held the lease
+// with another identity before. The hold keeps its fencing token, its sessions
+// and its deadline. If we already hold the lease, the sessions of identity are
+// added to our hold. It returns the previous holder, and false if identity
+// didn't hold the lease. If LeaseDuration is set, the hold is renewed by us.
+func (km *Kmutex) TakeOver(ctx xhdl.Context, identity, reason string) (previous Holder, taken bool) {
+	var token Token
+	km.withRecord(ctx, func(ctx xhdl.Context, r *record) bool {
+		i := r.holder(identity)
+		taken = i >= 0
+		if !taken {
+			return false
 		}
 
-		// check if we own
-		if *lease.Spec.HolderIdentity == km.HolderIdentity {
-			return true
+		previous = r.holders[i]
+		if j := r.holder(km.HolderIdentity); j >= 0 {
+			r.holders[j].Sessions = append(r.holders[j].Sessions, previous.Sessions...)
+			token = r.holders[j].Token
+			r.holders = append(r.holders[:i], r.holders[i+1:]...)
+		} else {
+			r.holders[i].Identity = km.HolderIdentity
+			r.holders[i].RenewTime = metav1.NewMicroTime(km.clock().Now())
+			token = previous.Token
 		}
 
-		// other owner, unable to acquire
-		return false
+		r.dequeue(km.HolderIdentity)
+		klog.Infof("hold of %s on %v taken over by %s: %s", identity, km.backend(), km.HolderIdentity, reason)
+		return true
 	})
 
+	if !taken {
+		return
+	}
+
+	km.observe(func(o Observer, lock string) { o.TakenOver(lock, previous, km.HolderIdentity, reason) })
+
+	km.mu.Lock()
+	km.token = token
+	km.mu.Unlock()
+
+	if km.LeaseDuration > 0 {
+		km.startRenewal()
+	}
+
+	return
+}
+
+// Lost returns a channel that is closed if the lease is lost while we
+// believe to hold it. This happens if renewal fails for longer than the
+// LeaseDuration, or if another holder has taken the lease over.
+// LostReason returns the cause.
+func (km *Kmutex) Lost() <-chan struct{} {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if km.lost == nil {
+		km.lost = make(chan struct{})
+	}
+
+	return km.lost
+}
+
+// LostReason returns why the lease has been lost, nil if not lost
+func (km *Kmutex) LostReason() error {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	return km.lostReason
+}
+
+func (km *Kmutex) renewInterval() time.Duration {
+	if km.RenewInterval > 0 {
+		return km.RenewInterval
+	}
+
+	return km.LeaseDuration / 3
+}
+
+// startRenewal starts the renewal goroutine if not already running
+func (km *Kmutex) startRenewal() {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if km.stopRenew != nil {
+		return
+	}
+
+	// a new hold gets a new lost channel, if the last one has fired
+	if km.lost == nil || km.lostReason != nil {
+		km.lost = make(chan struct{})
+		km.lostReason = nil
+	}
+
+	km.stopRenew = make(chan struct{})
+	go km.renew(km.stopRenew, km.lost)
+}
+
+func (km *Kmutex) stopRenewal() {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if km.stopRenew != nil {
+		close(km.stopRenew)
+		km.stopRenew = nil
+	}
 }
 
-func (km Kmutex) Release(ctx xhdl.Context) {
-	km.withLease(ctx, func(ctx xhdl.Context, lease *coordinationv1.Lease) (retry bool) {
-		if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != km.HolderIdentity {
-			panic("release a lock not held")
+// setLost notifies that the lease has been lost and stops the renewal
+func (km *Kmutex) setLost(stop, lost chan struct{}, reason error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	klog.Errorf("%v lost: %v", km.backend(), reason)
+
+	km.lostReason = reason
+	close(lost)
+
+	if km.stopRenew == stop {
+		km.stopRenew = nil
+	}
+}
+
+// renew is the renewal goroutine for a hold
+func (km *Kmutex) renew(stop chan struct{}, lost chan struct{}) {
+	ticker := km.clock().NewTicker(km.renewInterval())
+	defer ticker.Stop()
+
+	lastRenew := km.clock().Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+		}
+
+		var held, sessionsExpired bool
+		var owners []string
+		err := xhdl.Run(func(ctx xhdl.Context) {
+			held, owners, sessionsExpired = km.renewLease(ctx)
+		})
+
+		// Release may have been called while we renewed
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if err != nil {
+			klog.Warningf("failed to renew %v: %v", km.backend(), err)
+			if km.clock().Since(lastRenew) > km.LeaseDuration {
+				km.setLost(stop, lost, fmt.Errorf("lease not renewed within %v: %w", km.LeaseDuration, err))
+				return
+			}
+
+			continue
+		}
+
+		if sessionsExpired {
+			km.setLost(stop, lost, fmt.Errorf("all sessions expired, lease released"))
+			return
+		}
+
+		if !held {
+			km.setLost(stop, lost, fmt.Errorf("lease has been taken over by %q", strings.Join(owners, ",")))
+			return
+		}
+
+		lastRenew = km.clock().Now()
+	}
+}
+
+// renewLease updates the RenewTime if the lease is held by us, and returns the current owners.
+// Expired sessions are removed, and sessionsExpired is true if our hold has been released
+// because all of its sessions expired.
+func (km *Kmutex) renewLease(ctx xhdl.Context) (held bool, owners []string, sessionsExpired bool) {
+	var released []Holder
+	km.withRecord(ctx, func(ctx xhdl.Context, r *record) bool {
+		now := km.clock().Now()
+		released = r.pruneSessions(now)
+		sessionsExpired = slices.ContainsFunc(released, func(h Holder) bool { return h.Identity == km.HolderIdentity })
+		owners = r.owners(now)
+
+		i := r.holder(km.HolderIdentity)
+		held = i >= 0 && !r.expired(r.holders[i], now)
+		if held {
+			r.holders[i].RenewTime = metav1.NewMicroTime(now)
 		}
 
-		lease.Spec.HolderIdentity = nil
 		return true
 	})
+
+	for _, h := range released {
+		klog.Infof("sessions of %s on %v expired, releasing it", h.Identity, km.backend())
+		km.observe(func(o Observer, lock string) { o.TakenOver(lock, h, km.HolderIdentity, "sessions expired") })
+	}
+
+	return
 }
@@ -1,14 +1,25 @@
 package kmutex
 
 import (
+	"context"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/gprossliner/xhdl"
 	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes/fake"
+	clocktesting "k8s.io/utils/clock/testing"
 )
 
+// acquired returns the result of TryAcquire without the token
+func acquired(_ Token, ok bool) bool {
+	return ok
+}
+
 func TestAquireReleaseWithCreateLease(t *testing.T) {
 
 	cs := fake.NewSimpleClientset()
@@ -23,7 +34,7 @@ func TestAquireReleaseWithCreateLease(t *testing.T) {
 	}
 
 	err := xhdl.Run(func(ctx xhdl.Context) {
-		assert.True(t, km.TryAcquire(ctx))
+		assert.True(t, acquired(km.TryAcquire(ctx, HolderInfo{})))
 		km.Release(ctx)
 
 	})
@@ -57,16 +68,16 @@ func TestCantAcquireMutextHold(t *testing.T) {
 	err := xhdl.Run(func(ctx xhdl.Context) {
 
 		// task1 must be able to acquire
-		assert.True(t, task1.TryAcquire(ctx))
+		assert.True(t, acquired(task1.TryAcquire(ctx, HolderInfo{})))
 
 		// task2 must not be able to acquire because mutex held by task1
-		assert.False(t, task2.TryAcquire(ctx))
+		assert.False(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
 
 		// now task1 releases mutex
 		task1.Release(ctx)
 
 		// task2 must be able to acquire because mutex released by task1
-		assert.True(t, task2.TryAcquire(ctx))
+		assert.True(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
 	})
 
 	assert.NoError(t, err)
@@ -88,10 +99,10 @@ func TestAquireWhenAlreadyHeldShouldWork(t *testing.T) {
 	err := xhdl.Run(func(ctx xhdl.Context) {
 
 		// acquire once
-		assert.True(t, km.TryAcquire(ctx))
+		assert.True(t, acquired(km.TryAcquire(ctx, HolderInfo{})))
 
 		// and once more
-		assert.True(t, km.TryAcquire(ctx))
+		assert.True(t, acquired(km.TryAcquire(ctx, HolderInfo{})))
 
 		// release both
 		km.Release(ctx)
@@ -102,40 +113,96 @@ func TestAquireWhenAlreadyHeldShouldWork(t *testing.T) {
 
 }
 
-func TestReleaseLockNotHeldShouldPanic(t *testing.T) {
+func TestReleaseLockNotHeldShouldFail(t *testing.T) {
 
-	assert.Panics(t, func() {
-		cs := fake.NewSimpleClientset()
+	cs := fake.NewSimpleClientset()
 
-		task1 := Kmutex{
-			LeaseName:                  "lease",
-			LeaseNamespace:             "default",
-			HolderIdentity:             "task1",
-			DontCreateLeaseIfNotExists: false,
-			Clientset:                  cs,
-			RetryInterval:              time.Second,
-		}
+	task1 := Kmutex{
+		LeaseName:                  "lease",
+		LeaseNamespace:             "default",
+		HolderIdentity:             "task1",
+		DontCreateLeaseIfNotExists: false,
+		Clientset:                  cs,
+		RetryInterval:              time.Second,
+	}
 
-		task2 := Kmutex{
-			LeaseName:                  "lease",
-			LeaseNamespace:             "default",
-			HolderIdentity:             "task2",
-			DontCreateLeaseIfNotExists: false,
-			Clientset:                  cs,
-			RetryInterval:              time.Second,
-		}
+	task2 := Kmutex{
+		LeaseName:                  "lease",
+		LeaseNamespace:             "default",
+		HolderIdentity:             "task2",
+		DontCreateLeaseIfNotExists: false,
+		Clientset:                  cs,
+		RetryInterval:              time.Second,
+	}
 
-		xhdl.Run(func(ctx xhdl.Context) {
+	err := xhdl.Run(func(ctx xhdl.Context) {
 
-			// task1 must be able to acquire
-			assert.True(t, task1.TryAcquire(ctx))
+		// task1 must be able to acquire
+		assert.True(t, acquired(task1.TryAcquire(ctx, HolderInfo{})))
 
-			// this should panic as task2 do not own the lock
-			task2.Release(ctx)
-		})
+		// this should fail as task2 do not own the lock
+		task2.Release(ctx)
+	})
+
+	assert.ErrorIs(t, err, ErrNotHolder)
+}
+
+func TestLeaseMissing(t *testing.T) {
+
+	task := Kmutex{
+		LeaseName:                  "lease",
+		LeaseNamespace:             "default",
+		HolderIdentity:             "task",
+		DontCreateLeaseIfNotExists: true,
+		Clientset:                  fake.NewSimpleClientset(),
+	}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		task.TryAcquire(ctx, HolderInfo{})
+	})
+
+	assert.ErrorIs(t, err, ErrLeaseMissing)
+}
 
+// conflictingBackend fails every save with a conflict
+type conflictingBackend struct {
+	*MemoryBackend
+	saves int
+}
+
+func (b *conflictingBackend) save(ctx xhdl.Context, r *record) (string, error) {
+	b.saves++
+	return "", errors.NewConflict(schema.GroupResource{Resource: "memory"}, b.String(), fmt.Errorf("always"))
+}
+
+func TestConflictRetriesExhausted(t *testing.T) {
+
+	backend := &conflictingBackend{MemoryBackend: NewMemoryBackend()}
+	task := Kmutex{
+		HolderIdentity:     "task",
+		Backend:            backend,
+		RetryInterval:      time.Millisecond,
+		MaxConflictRetries: 3,
+	}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		task.TryAcquire(ctx, HolderInfo{})
 	})
 
+	assert.ErrorIs(t, err, ErrConflictRetriesExhausted)
+	assert.True(t, errors.IsConflict(err))
+	assert.Equal(t, 4, backend.saves)
+
+	// the backoff between the retries is canceled with the context
+	task.RetryInterval = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		task.TryAcquire(ctx, HolderInfo{})
+	})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
 }
 
 func TestCurrentOwner(t *testing.T) {
@@ -156,7 +223,7 @@ func TestCurrentOwner(t *testing.T) {
 		// owner should be "" if not owned
 		assert.Equal(t, "", km.CurrentOwner(ctx))
 
-		assert.True(t, km.TryAcquire(ctx))
+		assert.True(t, acquired(km.TryAcquire(ctx, HolderInfo{})))
 		assert.Equal(t, km.HolderIdentity, km.CurrentOwner(ctx))
 
 		km.Release(ctx)
@@ -167,3 +234,1201 @@ func TestCurrentOwner(t *testing.T) {
 	assert.NoError(t, err)
 
 }
+
+func TestExpiredLeaseCanBeTakenOver(t *testing.T) {
+
+	cs := fake.NewSimpleClientset()
+
+	task1 := Kmutex{
+		LeaseName:                  "lease",
+		LeaseNamespace:             "default",
+		HolderIdentity:             "task1",
+		DontCreateLeaseIfNotExists: false,
+		Clientset:                  cs,
+		RetryInterval:              time.Second,
+		LeaseDuration:              time.Minute,
+	}
+
+	task2 := Kmutex{
+		LeaseName:                  "lease",
+		LeaseNamespace:             "default",
+		HolderIdentity:             "task2",
+		DontCreateLeaseIfNotExists: false,
+		Clientset:                  cs,
+		RetryInterval:              time.Second,
+		LeaseDuration:              time.Minute,
+	}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+
+		// task1 acquires and sets the lease duration
+		assert.True(t, acquired(task1.TryAcquire(ctx, HolderInfo{})))
+		lease, err := cs.CoordinationV1().Leases("default").Get(ctx, "lease", metav1.GetOptions{})
+		ctx.Throw(err)
+		assert.Equal(t, int32(60), *lease.Spec.LeaseDurationSeconds)
+		assert.NotNil(t, lease.Spec.AcquireTime)
+		assert.NotNil(t, lease.Spec.RenewTime)
+
+		// while renewed task2 can't acquire
+		assert.False(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
+
+		// task1 dies and doesn't renew
+		expired := metav1.NewMicroTime(time.Now().Add(-time.Hour))
+		lease.Spec.RenewTime = &expired
+		_, err = cs.CoordinationV1().Leases("default").Update(ctx, lease, metav1.UpdateOptions{})
+		ctx.Throw(err)
+
+		// the expired lease is free
+		assert.Equal(t, "", task2.CurrentOwner(ctx))
+		assert.True(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
+		assert.Equal(t, "task2", task1.CurrentOwner(ctx))
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestRenewalAndLostNotification(t *testing.T) {
+
+	cs := fake.NewSimpleClientset()
+
+	km := Kmutex{
+		LeaseName:                  "lease",
+		LeaseNamespace:             "default",
+		HolderIdentity:             "me",
+		DontCreateLeaseIfNotExists: false,
+		Clientset:                  cs,
+		RetryInterval:              time.Second,
+		LeaseDuration:              time.Minute,
+		RenewInterval:              time.Millisecond * 10,
+	}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+
+		assert.True(t, acquired(km.TryAcquire(ctx, HolderInfo{})))
+		lease, err := cs.CoordinationV1().Leases("default").Get(ctx, "lease", metav1.GetOptions{})
+		ctx.Throw(err)
+		acquired := lease.Spec.RenewTime.Time
+
+		// the lease gets renewed in the background
+		assert.Eventually(t, func() bool {
+			lease, err := cs.CoordinationV1().Leases("default").Get(ctx, "lease", metav1.GetOptions{})
+			return err == nil && lease.Spec.RenewTime.After(acquired)
+		}, time.Second, time.Millisecond*10)
+
+		// another holder takes the lease over
+		lease, err = cs.CoordinationV1().Leases("default").Get(ctx, "lease", metav1.GetOptions{})
+		ctx.Throw(err)
+		other := "other"
+		lease.Spec.HolderIdentity = &other
+		_, err = cs.CoordinationV1().Leases("default").Update(ctx, lease, metav1.UpdateOptions{})
+		ctx.Throw(err)
+
+		select {
+		case <-km.Lost():
+			assert.ErrorContains(t, km.LostReason(), "other")
+		case <-time.After(time.Second):
+			assert.Fail(t, "lost not notified")
+		}
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestReleaseStopsRenewal(t *testing.T) {
+
+	cs := fake.NewSimpleClientset()
+
+	km := Kmutex{
+		LeaseName:                  "lease",
+		LeaseNamespace:             "default",
+		HolderIdentity:             "me",
+		DontCreateLeaseIfNotExists: false,
+		Clientset:                  cs,
+		RetryInterval:              time.Second,
+		LeaseDuration:              time.Minute,
+		RenewInterval:              time.Millisecond * 10,
+	}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		assert.True(t, acquired(km.TryAcquire(ctx, HolderInfo{})))
+		km.Release(ctx)
+
+		// no renewal must re-acquire the lease, and lost must not fire
+		time.Sleep(time.Millisecond * 50)
+		assert.Equal(t, "", km.CurrentOwner(ctx))
+		assert.NoError(t, km.LostReason())
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestMaxHolders(t *testing.T) {
+
+	cs := fake.NewSimpleClientset()
+
+	newTask := func(identity string) *Kmutex {
+		return &Kmutex{
+			LeaseName:                  "lease",
+			LeaseNamespace:             "default",
+			HolderIdentity:             identity,
+			DontCreateLeaseIfNotExists: false,
+			Clientset:                  cs,
+			RetryInterval:              time.Second,
+			MaxHolders:                 2,
+		}
+	}
+
+	task1, task2, task3 := newTask("task1"), newTask("task2"), newTask("task3")
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+
+		// two tasks can hold the lease
+		assert.True(t, acquired(task1.TryAcquire(ctx, HolderInfo{})))
+		assert.True(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
+		assert.Equal(t, []string{"task1", "task2"}, task3.CurrentOwners(ctx))
+
+		// but not a third one
+		assert.False(t, acquired(task3.TryAcquire(ctx, HolderInfo{})))
+
+		// until one releases
+		task1.Release(ctx)
+		assert.True(t, acquired(task3.TryAcquire(ctx, HolderInfo{})))
+		assert.Equal(t, []string{"task2", "task3"}, task1.CurrentOwners(ctx))
+
+		lease, err := cs.CoordinationV1().Leases("default").Get(ctx, "lease", metav1.GetOptions{})
+		ctx.Throw(err)
+		assert.Equal(t, "task2,task3", *lease.Spec.HolderIdentity)
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestMaxHoldersFunc(t *testing.T) {
+
+	backend := NewMemoryBackend()
+	limit := 1
+
+	newTask := func(identity string) *Kmutex {
+		return &Kmutex{
+			HolderIdentity: identity,
+			Backend:        backend,
+			MaxHolders:     5,
+			MaxHoldersFunc: func(ctx xhdl.Context) int { return limit },
+		}
+	}
+
+	task1, task2 := newTask("task1"), newTask("task2")
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+
+		// MaxHolders is replaced by the func
+		assert.True(t, acquired(task1.TryAcquire(ctx, HolderInfo{})))
+		assert.False(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
+
+		// which is called again on the next try
+		limit = 2
+		assert.True(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
+		assert.Equal(t, []string{"task1", "task2"}, task1.CurrentOwners(ctx))
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestWaitersAreGrantedInOrder(t *testing.T) {
+
+	cs := fake.NewSimpleClientset()
+
+	newTask := func(identity string) *Kmutex {
+		return &Kmutex{
+			LeaseName:                  "lease",
+			LeaseNamespace:             "default",
+			HolderIdentity:             identity,
+			DontCreateLeaseIfNotExists: false,
+			Clientset:                  cs,
+			RetryInterval:              time.Second,
+		}
+	}
+
+	task1, task2, task3 := newTask("task1"), newTask("task2"), newTask("task3")
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+
+		assert.True(t, acquired(task1.TryAcquire(ctx, HolderInfo{})))
+
+		// task2 queues before task3
+		assert.False(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
+		assert.False(t, acquired(task3.TryAcquire(ctx, HolderInfo{})))
+
+		position, waiting := task3.QueuePosition(ctx)
+		assert.Equal(t, 2, position)
+		assert.Equal(t, 2, waiting)
+
+		task1.Release(ctx)
+
+		// task3 is not at the head of the queue
+		assert.False(t, acquired(task3.TryAcquire(ctx, HolderInfo{})))
+		assert.True(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
+
+		position, waiting = task3.QueuePosition(ctx)
+		assert.Equal(t, 1, position)
+		assert.Equal(t, 1, waiting)
+
+		task2.Release(ctx)
+		assert.True(t, acquired(task3.TryAcquire(ctx, HolderInfo{})))
+
+		position, waiting = task3.QueuePosition(ctx)
+		assert.Equal(t, 0, position)
+		assert.Equal(t, 0, waiting)
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestStaleWaitersAreEvicted(t *testing.T) {
+
+	cs := fake.NewSimpleClientset()
+	clk := clocktesting.NewFakeClock(time.Now())
+
+	newTask := func(identity string) *Kmutex {
+		return &Kmutex{
+			LeaseName:                  "lease",
+			LeaseNamespace:             "default",
+			HolderIdentity:             identity,
+			DontCreateLeaseIfNotExists: false,
+			Clientset:                  cs,
+			RetryInterval:              time.Second,
+			Clock:                      clk,
+		}
+	}
+
+	task1, task2, task3 := newTask("task1"), newTask("task2"), newTask("task3")
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+
+		assert.True(t, acquired(task1.TryAcquire(ctx, HolderInfo{})))
+
+		// task2 queues, and then crashes
+		assert.False(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
+		clk.Step(2 * time.Minute)
+
+		// task3 queues, task2 is evicted
+		assert.False(t, acquired(task3.TryAcquire(ctx, HolderInfo{})))
+		position, waiting := task3.QueuePosition(ctx)
+		assert.Equal(t, 1, position)
+		assert.Equal(t, 1, waiting)
+
+		task1.Release(ctx)
+		assert.True(t, acquired(task3.TryAcquire(ctx, HolderInfo{})))
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestFencingTokens(t *testing.T) {
+
+	cs := fake.NewSimpleClientset()
+
+	newTask := func(identity string) *Kmutex {
+		return &Kmutex{
+			LeaseName:                  "lease",
+			LeaseNamespace:             "default",
+			HolderIdentity:             identity,
+			DontCreateLeaseIfNotExists: false,
+			Clientset:                  cs,
+			RetryInterval:              time.Second,
+		}
+	}
+
+	task1, task2 := newTask("task1"), newTask("task2")
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+
+		token1, ok := task1.TryAcquire(ctx, HolderInfo{})
+		assert.True(t, ok)
+		assert.True(t, task1.CheckToken(ctx, token1))
+
+		// acquire again returns the same token
+		token, ok := task1.TryAcquire(ctx, HolderInfo{})
+		assert.True(t, ok)
+		assert.Equal(t, token1, token)
+
+		task1.Release(ctx)
+		assert.False(t, task1.CheckToken(ctx, token1))
+
+		// the next holder gets a greater token
+		token2, ok := task2.TryAcquire(ctx, HolderInfo{})
+		assert.True(t, ok)
+		assert.Greater(t, token2, token1)
+		assert.False(t, task1.CheckToken(ctx, token2))
+
+		lease, err := cs.CoordinationV1().Leases("default").Get(ctx, "lease", metav1.GetOptions{})
+		ctx.Throw(err)
+		assert.Equal(t, int32(token2), *lease.Spec.LeaseTransitions)
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestReleaseWithStaleToken(t *testing.T) {
+
+	cs := fake.NewSimpleClientset()
+
+	newTask := func() *Kmutex {
+		return &Kmutex{
+			LeaseName:                  "lease",
+			LeaseNamespace:             "default",
+			HolderIdentity:             "me",
+			DontCreateLeaseIfNotExists: false,
+			Clientset:                  cs,
+			RetryInterval:              time.Second,
+		}
+	}
+
+	paused, current := newTask(), newTask()
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		assert.True(t, acquired(paused.TryAcquire(ctx, HolderInfo{})))
+
+		// the hold of paused gets lost, and the lease is acquired again
+		current.Release(ctx)
+		assert.True(t, acquired(current.TryAcquire(ctx, HolderInfo{})))
+
+		// paused can't release the lease of current
+		paused.Release(ctx)
+	})
+
+	assert.ErrorIs(t, err, ErrStaleToken)
+}
+
+func TestAcquireWaitsForRelease(t *testing.T) {
+
+	cs := fake.NewSimpleClientset()
+
+	newTask := func(identity string) *Kmutex {
+		return &Kmutex{
+			LeaseName:                  "lease",
+			LeaseNamespace:             "default",
+			HolderIdentity:             identity,
+			DontCreateLeaseIfNotExists: false,
+			Clientset:                  cs,
+			RetryInterval:              time.Second,
+		}
+	}
+
+	task1, task2 := newTask("task1"), newTask("task2")
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		assert.True(t, acquired(task1.TryAcquire(ctx, HolderInfo{})))
+	})
+	assert.NoError(t, err)
+
+	waiting := make(chan WaitStatus, 1)
+	done := make(chan Token)
+	go func() {
+		xhdl.Run(func(ctx xhdl.Context) {
+			done <- task2.Acquire(ctx, HolderInfo{}, func(ctx xhdl.Context, status WaitStatus) {
+				waiting <- status
+			})
+		})
+	}()
+
+	status := <-waiting
+	assert.Equal(t, []string{"task1"}, status.Owners)
+	assert.Equal(t, 1, status.Position)
+
+	// task2 must not acquire while task1 holds the lease
+	select {
+	case <-done:
+		assert.Fail(t, "acquired while held")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	err = xhdl.Run(func(ctx xhdl.Context) {
+		task1.Release(ctx)
+	})
+	assert.NoError(t, err)
+
+	select {
+	case token := <-done:
+		assert.Equal(t, Token(2), token)
+	case <-time.After(time.Second):
+		assert.Fail(t, "not acquired after release")
+	}
+}
+
+func TestReadOnlyOperationsDontUpdate(t *testing.T) {
+
+	cs := fake.NewSimpleClientset()
+
+	km := Kmutex{
+		LeaseName:                  "lease",
+		LeaseNamespace:             "default",
+		HolderIdentity:             "me",
+		DontCreateLeaseIfNotExists: false,
+		Clientset:                  cs,
+		RetryInterval:              time.Second,
+	}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		token, ok := km.TryAcquire(ctx, HolderInfo{})
+		assert.True(t, ok)
+
+		cs.ClearActions()
+		km.CurrentOwner(ctx)
+		km.CurrentOwners(ctx)
+		km.QueuePosition(ctx)
+		km.CheckToken(ctx, token)
+
+		for _, action := range cs.Actions() {
+			assert.Equal(t, "get", action.GetVerb())
+		}
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestBackends(t *testing.T) {
+
+	backends := map[string]func() Backend{
+		"lease": func() Backend {
+			return NewLeaseBackend(fake.NewSimpleClientset(), "default", "lock")
+		},
+		"configmap": func() Backend {
+			return NewConfigMapBackend(fake.NewSimpleClientset(), "default", "lock")
+		},
+		"memory": func() Backend {
+			return NewMemoryBackend()
+		},
+	}
+
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			backend := newBackend()
+
+			newTask := func(identity string) *Kmutex {
+				return &Kmutex{
+					HolderIdentity: identity,
+					Backend:        backend,
+					RetryInterval:  time.Millisecond,
+					LeaseDuration:  time.Minute,
+				}
+			}
+
+			task1, task2 := newTask("task1"), newTask("task2")
+
+			err := xhdl.Run(func(ctx xhdl.Context) {
+				token, ok := task1.TryAcquire(ctx, HolderInfo{})
+				assert.True(t, ok)
+				assert.Equal(t, Token(1), token)
+				assert.False(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
+
+				desc := task2.Describe(ctx)
+				assert.Equal(t, backend.String(), desc.Backend)
+				assert.Equal(t, "task1", desc.Holders[0].Identity)
+				assert.Equal(t, "task2", desc.Waiters[0].Identity)
+				assert.Equal(t, time.Minute, desc.LeaseDuration)
+
+				task1.Release(ctx)
+			})
+			assert.NoError(t, err)
+
+			var token Token
+			err = xhdl.Run(func(ctx xhdl.Context) {
+				token = task2.Acquire(ctx, HolderInfo{}, nil)
+				assert.Equal(t, []string{"task2"}, task1.CurrentOwners(ctx))
+				task2.Release(ctx)
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, Token(2), token)
+		})
+	}
+}
+
+func TestMemoryBackendConflict(t *testing.T) {
+
+	backend := NewMemoryBackend()
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		r1 := backend.load(ctx, true)
+		r2 := backend.load(ctx, true)
+
+		_, err := backend.save(ctx, r1)
+		assert.NoError(t, err)
+
+		_, err = backend.save(ctx, r2)
+		assert.True(t, errors.IsConflict(err))
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestHolderInfo(t *testing.T) {
+
+	cs := fake.NewSimpleClientset()
+
+	km := Kmutex{
+		LeaseName:                  "lease",
+		LeaseNamespace:             "default",
+		HolderIdentity:             "me",
+		DontCreateLeaseIfNotExists: false,
+		Clientset:                  cs,
+		RetryInterval:              time.Second,
+	}
+
+	info := HolderInfo{
+		Version: "v1.0.0",
+		Session: "1234",
+		Reason:  "os update",
+		Client:  "update.sh",
+	}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		before := time.Now().Add(-time.Second)
+		assert.True(t, acquired(km.TryAcquire(ctx, info)))
+
+		// acquire again doesn't change the info
+		assert.True(t, acquired(km.TryAcquire(ctx, HolderInfo{Reason: "other"})))
+
+		desc := km.Describe(ctx)
+		assert.Len(t, desc.Holders, 1)
+		assert.Equal(t, "me", desc.Holders[0].Identity)
+		assert.Equal(t, info, desc.Holders[0].HolderInfo)
+		assert.True(t, desc.Holders[0].AcquireTime.After(before))
+
+		// and it is visible on the lease
+		lease, err := cs.CoordinationV1().Leases("default").Get(ctx, "lease", metav1.GetOptions{})
+		ctx.Throw(err)
+		assert.Contains(t, lease.Annotations[annotationHolders], `"reason":"os update"`)
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestForceRelease(t *testing.T) {
+
+	cs := fake.NewSimpleClientset()
+
+	newTask := func(identity string) *Kmutex {
+		return &Kmutex{
+			LeaseName:                  "lease",
+			LeaseNamespace:             "default",
+			HolderIdentity:             identity,
+			DontCreateLeaseIfNotExists: false,
+			Clientset:                  cs,
+			RetryInterval:              time.Second,
+		}
+	}
+
+	dead, admin := newTask("dead"), newTask("admin")
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		token, ok := dead.TryAcquire(ctx, HolderInfo{Reason: "update"})
+		assert.True(t, ok)
+
+		// not held by admin
+		_, released := admin.ForceRelease(ctx, "admin", "test")
+		assert.False(t, released)
+		assert.Equal(t, "dead", admin.CurrentOwner(ctx))
+
+		removed, released := admin.ForceRelease(ctx, "dead", "node is gone")
+		assert.True(t, released)
+		assert.Equal(t, token, removed.Token)
+		assert.Equal(t, "", admin.CurrentOwner(ctx))
+
+		desc := admin.Describe(ctx)
+		assert.Equal(t, "dead", desc.LastForceRelease.Holder.Identity)
+		assert.Equal(t, "update", desc.LastForceRelease.Holder.Reason)
+		assert.Equal(t, "admin", desc.LastForceRelease.By)
+		assert.Equal(t, "node is gone", desc.LastForceRelease.Reason)
+		assert.False(t, dead.CheckToken(ctx, token))
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestTakeOver(t *testing.T) {
+
+	backend := NewMemoryBackend()
+	old := Kmutex{HolderIdentity: "node1", Backend: backend}
+	km := Kmutex{HolderIdentity: "node1/uid1", Backend: backend}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		token, ok := old.TryAcquire(ctx, HolderInfo{Session: "s1", Reason: "update"})
+		assert.True(t, ok)
+
+		_, taken := km.TakeOver(ctx, "other", "test")
+		assert.False(t, taken)
+
+		previous, taken := km.TakeOver(ctx, "node1", "identity changed")
+		assert.True(t, taken)
+		assert.Equal(t, token, previous.Token)
+
+		// the hold keeps its token and sessions
+		assert.Equal(t, []string{"node1/uid1"}, km.CurrentOwners(ctx))
+		assert.True(t, km.CheckToken(ctx, token))
+		h := km.Describe(ctx).Holders[0]
+		assert.Equal(t, "update", h.Reason)
+		assert.Equal(t, "s1", h.Sessions[0].Session)
+
+		assert.False(t, km.ReleaseSession(ctx, "s1"))
+		assert.Empty(t, km.CurrentOwners(ctx))
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestSessions(t *testing.T) {
+
+	km := Kmutex{
+		HolderIdentity: "me",
+		Backend:        NewMemoryBackend(),
+	}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		token1, ok := km.TryAcquire(ctx, HolderInfo{Session: "s1", Client: "os-update"})
+		assert.True(t, ok)
+
+		// a second session of the same holder gets the same hold
+		token2, ok := km.TryAcquire(ctx, HolderInfo{Session: "s2", Client: "firmware"})
+		assert.True(t, ok)
+		assert.Equal(t, token1, token2)
+
+		desc := km.Describe(ctx)
+		assert.Len(t, desc.Holders, 1)
+		assert.Len(t, desc.Holders[0].Sessions, 2)
+		assert.Equal(t, "firmware", desc.Holders[0].Sessions[1].Client)
+
+		// unknown sessions can't release
+		err := xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+			km.ReleaseSession(ctx, "other")
+		})
+		assert.ErrorIs(t, err, ErrUnknownSession)
+
+		// the lock is held until the last session is released
+		assert.True(t, km.ReleaseSession(ctx, "s1"))
+		assert.Equal(t, "me", km.CurrentOwner(ctx))
+
+		assert.False(t, km.ReleaseSession(ctx, "s2"))
+		assert.Equal(t, "", km.CurrentOwner(ctx))
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestSessionTimeout(t *testing.T) {
+
+	backend := NewMemoryBackend()
+	clk := clocktesting.NewFakeClock(time.Now())
+	km := Kmutex{HolderIdentity: "me", Backend: backend, Clock: clk, SessionTimeout: time.Hour}
+	other := Kmutex{HolderIdentity: "other", Backend: backend, Clock: clk}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		assert.True(t, acquired(km.TryAcquire(ctx, HolderInfo{Session: "crashed"})))
+		assert.True(t, acquired(km.TryAcquire(ctx, HolderInfo{Session: "alive"})))
+
+		// the refreshed session keeps the hold, the other one expires
+		clk.Step(40 * time.Minute)
+		km.RefreshSession(ctx, "alive")
+		clk.Step(40 * time.Minute)
+
+		assert.False(t, acquired(other.TryAcquire(ctx, HolderInfo{})))
+		sessions := km.Describe(ctx).Holders[0].Sessions
+		assert.Len(t, sessions, 1)
+		assert.Equal(t, "alive", sessions[0].Session)
+
+		err := xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+			km.RefreshSession(ctx, "crashed")
+		})
+		assert.ErrorIs(t, err, ErrUnknownSession)
+
+		// the hold is released when the last session expires
+		clk.Step(time.Hour)
+		assert.True(t, acquired(other.TryAcquire(ctx, HolderInfo{})))
+		assert.Equal(t, []string{"other"}, other.CurrentOwners(ctx))
+
+		err = xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+			km.RefreshSession(ctx, "alive")
+		})
+		assert.ErrorIs(t, err, ErrNotHolder)
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestReady(t *testing.T) {
+
+	backend := NewMemoryBackend()
+	notReady := fmt.Errorf("not ready")
+	ready := notReady
+
+	// the short ticket timeout lets Acquire try again soon
+	task1 := &Kmutex{HolderIdentity: "task1", Backend: backend, TicketTimeout: 300 * time.Millisecond, Ready: func(ctx xhdl.Context) error { return ready }}
+	task2 := &Kmutex{HolderIdentity: "task2", Backend: backend}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		// task1 keeps its place in the queue while not ready
+		assert.False(t, acquired(task1.TryAcquire(ctx, HolderInfo{})))
+		assert.False(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
+		assert.Equal(t, "", task1.CurrentOwner(ctx))
+
+		position, waiting := task1.QueuePosition(ctx)
+		assert.Equal(t, 1, position)
+		assert.Equal(t, 2, waiting)
+
+		// and gets the lock when ready
+		var status WaitStatus
+		token := task1.Acquire(ctx, HolderInfo{}, func(ctx xhdl.Context, s WaitStatus) {
+			status = s
+			ready = nil
+		})
+		assert.ErrorIs(t, status.NotReady, notReady)
+		assert.Equal(t, 1, status.Position)
+		assert.True(t, task1.CheckToken(ctx, token))
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestAcquireAllBacksOffOnPartialFailure(t *testing.T) {
+
+	global, rack := NewMemoryBackend(), NewMemoryBackend()
+	newTask := func(identity string, backend Backend) *Kmutex {
+		return &Kmutex{HolderIdentity: identity, Backend: backend}
+	}
+
+	group := NewGroup(newTask("me", global), newTask("me", rack))
+	other := newTask("other", rack)
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		assert.True(t, acquired(other.TryAcquire(ctx, HolderInfo{})))
+
+		// the global lock is not kept while the rack lock is held by other
+		assert.False(t, acquired(group.TryAcquire(ctx, HolderInfo{})))
+		assert.Equal(t, "", group.Locks[0].CurrentOwner(ctx))
+
+		other.Release(ctx)
+		token, ok := group.TryAcquire(ctx, HolderInfo{})
+		assert.True(t, ok)
+		assert.True(t, group.CheckToken(ctx, token))
+		assert.Equal(t, "me", group.Locks[0].CurrentOwner(ctx))
+		assert.Equal(t, "me", group.Locks[1].CurrentOwner(ctx))
+
+		// and released as a unit
+		group.Release(ctx)
+		assert.Equal(t, "", group.Locks[0].CurrentOwner(ctx))
+		assert.Equal(t, "", group.Locks[1].CurrentOwner(ctx))
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestAcquireAllLeavesOtherQueuesOnPartialFailure(t *testing.T) {
+
+	newTask := func(identity string, backend Backend) *Kmutex {
+		return &Kmutex{HolderIdentity: identity, Backend: backend}
+	}
+
+	group := NewGroup(newTask("p1", NewMemoryBackend()), newTask("p1", NewMemoryBackend()))
+	a, b := group.ordered()[0].Backend, group.ordered()[1].Backend
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		// p1 gets a, and queues on b held by p2
+		p2 := newTask("p2", b)
+		assert.True(t, acquired(p2.TryAcquire(ctx, HolderInfo{})))
+		assert.False(t, acquired(group.TryAcquire(ctx, HolderInfo{})))
+
+		// and then fails on a held by p4
+		p4 := newTask("p4", a)
+		assert.True(t, acquired(p4.TryAcquire(ctx, HolderInfo{})))
+		assert.False(t, acquired(group.TryAcquire(ctx, HolderInfo{})))
+		waiters := p4.Describe(ctx).Waiters
+		assert.Len(t, waiters, 1)
+		assert.Equal(t, "p1", waiters[0].Identity)
+
+		// so its stale ticket doesn't block b when it gets free
+		p2.Release(ctx)
+		assert.Empty(t, p2.Describe(ctx).Waiters)
+		assert.True(t, acquired(newTask("p3", b).TryAcquire(ctx, HolderInfo{})))
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestAcquireAllKeepsPlaceInQueues(t *testing.T) {
+
+	newTask := func(identity string, backend Backend, exclusive bool) *Kmutex {
+		return &Kmutex{HolderIdentity: identity, Backend: backend, MaxHolders: 2, Exclusive: exclusive}
+	}
+
+	// an exclusive operation on the locks of two busy groups
+	group := NewGroup(newTask("op", NewMemoryBackend(), true), newTask("op", NewMemoryBackend(), true))
+	a, b := group.ordered()[0].Backend, group.ordered()[1].Backend
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		b1 := newTask("b1", b, false)
+		assert.True(t, acquired(b1.TryAcquire(ctx, HolderInfo{})))
+
+		// op gets a and waits for b, but keeps its place on a
+		assert.False(t, acquired(group.TryAcquire(ctx, HolderInfo{})))
+		assert.Empty(t, newTask("a1", a, false).CurrentOwners(ctx))
+		assert.False(t, acquired(newTask("a1", a, false).TryAcquire(ctx, HolderInfo{})))
+
+		// and on b, when it gets free
+		b1.Release(ctx)
+		assert.False(t, acquired(newTask("b2", b, false).TryAcquire(ctx, HolderInfo{})))
+
+		token, ok := group.TryAcquire(ctx, HolderInfo{})
+		assert.True(t, ok)
+		assert.True(t, group.CheckToken(ctx, token))
+		waiters := newTask("a1", a, false).Describe(ctx).Waiters
+		assert.Len(t, waiters, 1)
+		assert.Equal(t, "a1", waiters[0].Identity)
+	})
+
+	assert.NoError(t, err)
+}
+
+// cancelableBackend fails like the api server, if the context has been canceled
+type cancelableBackend struct {
+	*MemoryBackend
+}
+
+func (b cancelableBackend) load(ctx xhdl.Context, create bool) *record {
+	ctx.Throw(ctx.Err())
+	return b.MemoryBackend.load(ctx, create)
+}
+
+func (b cancelableBackend) save(ctx xhdl.Context, r *record) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	return b.MemoryBackend.save(ctx, r)
+}
+
+func TestAcquireAllReleasesAfterCancel(t *testing.T) {
+
+	newTask := func() *Kmutex {
+		return &Kmutex{HolderIdentity: "me", Backend: cancelableBackend{NewMemoryBackend()}}
+	}
+
+	group := NewGroup(newTask(), newTask())
+	first, second := group.ordered()[0], group.ordered()[1]
+
+	// the client disconnects while we try to get the second lock
+	ctx, cancel := context.WithCancel(context.Background())
+	second.Ready = func(ctx xhdl.Context) error {
+		cancel()
+		ctx.Throw(ctx.Err())
+		return nil
+	}
+
+	err := xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		group.TryAcquire(ctx, HolderInfo{})
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// the first lock is released, and the queues are left anyway
+	err = xhdl.Run(func(ctx xhdl.Context) {
+		assert.Empty(t, first.CurrentOwners(ctx))
+		assert.Empty(t, second.Describe(ctx).Waiters)
+	})
+	assert.NoError(t, err)
+}
+
+func TestAcquireAllOverlappingDoesntDeadlock(t *testing.T) {
+
+	for name, exclusive := range map[string]bool{"shared": false, "exclusive": true} {
+		t.Run(name, func(t *testing.T) {
+			a, b := NewMemoryBackend(), NewMemoryBackend()
+			newTask := func(identity string, backend Backend) *Kmutex {
+				return &Kmutex{HolderIdentity: identity, Backend: backend, Exclusive: exclusive}
+			}
+
+			// both request the same locks in a different order
+			done := make(chan error, 2)
+			for _, identity := range []string{"task1", "task2"} {
+				backends := []Backend{a, b}
+				if identity == "task2" {
+					backends = []Backend{b, a}
+				}
+
+				go func() {
+					done <- xhdl.Run(func(ctx xhdl.Context) {
+						for i := 0; i < 10; i++ {
+							group, _ := AcquireAll(ctx, HolderInfo{}, nil, newTask(identity, backends[0]), newTask(identity, backends[1]))
+							group.Release(ctx)
+						}
+					})
+				}()
+			}
+
+			for i := 0; i < 2; i++ {
+				select {
+				case err := <-done:
+					assert.NoError(t, err)
+				case <-time.After(10 * time.Second):
+					t.Fatal("deadlock")
+				}
+			}
+		})
+	}
+}
+
+func TestExclusive(t *testing.T) {
+
+	backend := NewMemoryBackend()
+	newTask := func(identity string, exclusive bool) *Kmutex {
+		return &Kmutex{HolderIdentity: identity, Backend: backend, MaxHolders: 3, Exclusive: exclusive}
+	}
+
+	node1, node2, node3 := newTask("node1", false), newTask("node2", false), newTask("node3", false)
+	cluster := newTask("cluster", true)
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		assert.True(t, acquired(node1.TryAcquire(ctx, HolderInfo{})))
+
+		// the exclusive holder waits for the shared holders
+		assert.False(t, acquired(cluster.TryAcquire(ctx, HolderInfo{})))
+
+		// shared waiters after the exclusive waiter wait too, even if there is a free slot
+		assert.False(t, acquired(node2.TryAcquire(ctx, HolderInfo{})))
+
+		node1.Release(ctx)
+		assert.True(t, acquired(cluster.TryAcquire(ctx, HolderInfo{})))
+		assert.True(t, cluster.Describe(ctx).Holders[0].Exclusive)
+
+		// nobody shares an exclusive hold
+		assert.False(t, acquired(node2.TryAcquire(ctx, HolderInfo{})))
+		assert.False(t, acquired(node3.TryAcquire(ctx, HolderInfo{})))
+
+		cluster.Release(ctx)
+		assert.True(t, acquired(node2.TryAcquire(ctx, HolderInfo{})))
+		assert.True(t, acquired(node3.TryAcquire(ctx, HolderInfo{})))
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestDomains(t *testing.T) {
+
+	backend := NewMemoryBackend()
+	newTask := func(identity, domain string) *Kmutex {
+		return &Kmutex{HolderIdentity: identity, Backend: backend, MaxHolders: 3, Domain: domain}
+	}
+
+	a1, a2, b1, c1 := newTask("a1", "a"), newTask("a2", "a"), newTask("b1", "b"), newTask("c1", "c")
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		assert.True(t, acquired(a1.TryAcquire(ctx, HolderInfo{})))
+		assert.Equal(t, "a", a1.Describe(ctx).Holders[0].Domain)
+
+		// one holder per domain, also if there is a free slot
+		assert.False(t, acquired(a2.TryAcquire(ctx, HolderInfo{})))
+
+		// the other domains are not queued after the waiter of a held domain
+		assert.True(t, acquired(b1.TryAcquire(ctx, HolderInfo{})))
+		assert.True(t, acquired(c1.TryAcquire(ctx, HolderInfo{})))
+		assert.Equal(t, []string{"a1", "b1", "c1"}, a1.CurrentOwners(ctx))
+
+		// the slot of c1 is not given to a2, a1 still holds domain a
+		c1.Release(ctx)
+		assert.False(t, acquired(a2.TryAcquire(ctx, HolderInfo{})))
+
+		a1.Release(ctx)
+		assert.True(t, acquired(a2.TryAcquire(ctx, HolderInfo{})))
+	})
+
+	assert.NoError(t, err)
+}
+
+func TestMaxHoldDuration(t *testing.T) {
+
+	backend := NewMemoryBackend()
+	km := Kmutex{HolderIdentity: "me", Backend: backend, MaxHoldDuration: time.Hour}
+	other := Kmutex{HolderIdentity: "other", Backend: backend}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+
+		// others can't extend our hold
+		err := xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+			other.Extend(ctx, time.Hour, "other")
+		})
+		assert.ErrorIs(t, err, ErrNotHolder)
+
+		assert.True(t, acquired(km.TryAcquire(ctx, HolderInfo{})))
+
+		h := km.Describe(ctx).Holders[0]
+		assert.NotNil(t, h.Deadline)
+		assert.False(t, h.Overdue(time.Now()))
+		assert.True(t, h.Overdue(time.Now().Add(2*time.Hour)))
+
+		deadline := km.Extend(ctx, 3*time.Hour, "update takes longer")
+		h = km.Describe(ctx).Holders[0]
+		assert.False(t, h.Overdue(time.Now().Add(2*time.Hour)))
+		assert.Equal(t, deadline, h.Deadline.Time)
+		assert.Equal(t, "update takes longer", h.Extensions[0].Reason)
+
+		// other holds have no deadline
+		km.Release(ctx)
+		assert.True(t, acquired(other.TryAcquire(ctx, HolderInfo{})))
+		assert.Nil(t, other.Describe(ctx).Holders[0].Deadline)
+	})
+
+	assert.NoError(t, err)
+}
+
+// recordingObserver records the transitions of a Kmutex
+type recordingObserver struct {
+	events []string
+	waits  []time.Duration
+}
+
+func (o *recordingObserver) AcquireAttempt(lock, identity string) {
+	o.events = append(o.events, "attempt "+identity)
+}
+
+func (o *recordingObserver) Acquired(lock, identity string, token Token, wait time.Duration) {
+	o.events = append(o.events, fmt.Sprintf("acquired %s %d", identity, token))
+	o.waits = append(o.waits, wait)
+}
+
+func (o *recordingObserver) ConflictRetry(lock string, retry int, err error) {
+	o.events = append(o.events, fmt.Sprintf("conflict %d", retry))
+}
+
+func (o *recordingObserver) Released(lock, identity string, token Token) {
+	o.events = append(o.events, fmt.Sprintf("released %s %d", identity, token))
+}
+
+func (o *recordingObserver) TakenOver(lock string, previous Holder, identity, reason string) {
+	o.events = append(o.events, fmt.Sprintf("takeover %s by %s: %s", previous.Identity, identity, reason))
+}
+
+func TestObserver(t *testing.T) {
+
+	backend := NewMemoryBackend()
+	observer := &recordingObserver{}
+	newTask := func(identity string) *Kmutex {
+		return &Kmutex{HolderIdentity: identity, Backend: backend, Observer: observer}
+	}
+
+	task1, task2, task3 := newTask("task1"), newTask("task2"), newTask("task3")
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		assert.True(t, acquired(task1.TryAcquire(ctx, HolderInfo{})))
+		assert.False(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
+		time.Sleep(10 * time.Millisecond)
+
+		task1.Release(ctx)
+		assert.True(t, acquired(task2.TryAcquire(ctx, HolderInfo{})))
+		task3.ForceRelease(ctx, "task2", "dead")
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"attempt task1",
+		"acquired task1 1",
+		"attempt task2",
+		"released task1 1",
+		"attempt task2",
+		"acquired task2 2",
+		"takeover task2 by task3: dead",
+	}, observer.events)
+
+	// task2 has waited in the queue
+	assert.Equal(t, time.Duration(0), observer.waits[0])
+	assert.Greater(t, observer.waits[1], 10*time.Millisecond)
+
+	// conflicts are reported before retrying
+	conflicting := &conflictingBackend{MemoryBackend: NewMemoryBackend()}
+	observer = &recordingObserver{}
+	task := Kmutex{HolderIdentity: "task", Backend: conflicting, Observer: observer, MaxConflictRetries: 2}
+
+	xhdl.Run(func(ctx xhdl.Context) {
+		task.TryAcquire(ctx, HolderInfo{})
+	})
+
+	assert.Equal(t, []string{"attempt task", "conflict 1", "conflict 2"}, observer.events)
+}
+
+func TestCanceledWaiterLeavesQueue(t *testing.T) {
+
+	backend := NewMemoryBackend()
+	task1 := &Kmutex{HolderIdentity: "task1", Backend: backend}
+	task2 := &Kmutex{HolderIdentity: "task2", Backend: backend}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		assert.True(t, acquired(task1.TryAcquire(ctx, HolderInfo{})))
+	})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := make(chan struct{}, 1)
+	done := make(chan error)
+	go func() {
+		done <- xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+			task2.Acquire(ctx, HolderInfo{}, func(ctx xhdl.Context, status WaitStatus) {
+				waiting <- struct{}{}
+			})
+		})
+	}()
+
+	// the waiter is visible while waiting
+	<-waiting
+	err = xhdl.Run(func(ctx xhdl.Context) {
+		waiters := task1.Describe(ctx).Waiters
+		assert.Len(t, waiters, 1)
+		assert.Equal(t, "task2", waiters[0].Identity)
+	})
+	assert.NoError(t, err)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	err = xhdl.Run(func(ctx xhdl.Context) {
+		assert.Empty(t, task1.Describe(ctx).Waiters)
+	})
+	assert.NoError(t, err)
+}
+
+func TestAcquireWaitsForExpiryWithFakeClock(t *testing.T) {
+
+	backend := NewMemoryBackend()
+	clk := clocktesting.NewFakeClock(time.Now())
+
+	// task1 dies without renewing the lease. It runs on its own clock, so
+	// that its renewal ticker is not a waiter of the clock of task2.
+	task1 := &Kmutex{HolderIdentity: "task1", Backend: backend, Clock: clocktesting.NewFakeClock(clk.Now()), LeaseDuration: time.Hour}
+	task2 := &Kmutex{HolderIdentity: "task2", Backend: backend, Clock: clk, LeaseDuration: time.Hour}
+
+	err := xhdl.Run(func(ctx xhdl.Context) {
+		assert.True(t, acquired(task1.TryAcquire(ctx, HolderInfo{})))
+	})
+	assert.NoError(t, err)
+
+	start := clk.Now()
+	done := make(chan Token)
+	go func() {
+		xhdl.Run(func(ctx xhdl.Context) {
+			done <- task2.Acquire(ctx, HolderInfo{}, nil)
+		})
+	}()
+
+	// hours of waiting pass in steps of the ticket refresh
+	for i := 0; i < 2*60*3; i++ {
+		select {
+		case token := <-done:
+			assert.Equal(t, Token(2), token)
+			assert.Greater(t, clk.Since(start), time.Hour)
+			return
+		default:
+		}
+
+		// task2 waits for its timer
+		assert.Eventually(t, func() bool { return clk.HasWaiters() }, time.Second, time.Millisecond)
+		clk.Step(20 * time.Second)
+	}
+
+	assert.Fail(t, "not acquired after expiry")
+}
@@ -0,0 +1,265 @@
+package kmutex
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gprossliner/xhdl"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// leaseBackend stores the record in a coordination.k8s.io/v1 Lease.
+// The Spec of the lease mirrors the holders, so that a single holder looks
+// like any other Lease, and a lease edited by hand is still respected.
+type leaseBackend struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewLeaseBackend returns a Backend storing the lock in a Lease
+func NewLeaseBackend(clientset kubernetes.Interface, namespace, name string) Backend {
+	return leaseBackend{clientset, namespace, name}
+}
+
+func (b leaseBackend) String() string {
+	return fmt.Sprintf("lease %v/%v", b.namespace, b.name)
+}
+
+func (b leaseBackend) get(ctx xhdl.Context) *record {
+	lease, err := b.clientset.CoordinationV1().Leases(b.namespace).Get(ctx, b.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return &record{}
+	}
+	ctx.Throw(err)
+
+	r, err := decodeLease(lease)
+	ctx.Throw(err)
+	return r
+}
+
+func (b leaseBackend) load(ctx xhdl.Context, create bool) *record {
+	li := b.clientset.CoordinationV1().Leases(b.namespace)
+
+	lease, err := li.Get(ctx, b.name, metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			ctx.Throw(err)
+		}
+
+		if !create {
+			ctx.Throw(fmt.Errorf("%v: %w", b, ErrLeaseMissing))
+		}
+
+		klog.Infof("%v not found, creating", b)
+
+		// the fake.NewSimpleClientset() doesn't create a new instance, like the
+		// real kubernetes.Clientset, so we create it here if it is nil to
+		// make the test work
+		if lease == nil {
+			lease = &coordinationv1.Lease{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Lease",
+					APIVersion: "coordination.k8s.io/v1",
+				},
+			}
+		}
+
+		lease.Name = b.name
+		lease.Namespace = b.namespace
+
+		lcreated, err := li.Create(ctx, lease, metav1.CreateOptions{})
+		ctx.Throw(err)
+		lease = lcreated
+	}
+
+	r, err := decodeLease(lease)
+	ctx.Throw(err)
+	return r
+}
+
+func (b leaseBackend) save(ctx xhdl.Context, r *record) (string, error) {
+	lease := r.object.(*coordinationv1.Lease).DeepCopy()
+	if err := encodeLease(lease, r); err != nil {
+		return "", err
+	}
+
+	updated, err := b.clientset.CoordinationV1().Leases(b.namespace).Update(ctx, lease, metav1.UpdateOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	return updated.ResourceVersion, nil
+}
+
+func (b leaseBackend) watch(ctx context.Context, version string) (<-chan *record, error) {
+	w, err := b.clientset.CoordinationV1().Leases(b.namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", b.name).String(),
+		ResourceVersion: version,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return watchRecords(ctx, w, func(obj any) (*record, bool) {
+		lease, ok := obj.(*coordinationv1.Lease)
+		if !ok || lease.Name != b.name {
+			return nil, false
+		}
+
+		r, err := decodeLease(lease)
+		return r, err == nil
+	}), nil
+}
+
+// watchRecords converts the events of w to records, until the watch or ctx is done.
+// decode returns false for objects to skip.
+func watchRecords(ctx context.Context, w watch.Interface, decode func(obj any) (*record, bool)) <-chan *record {
+	records := make(chan *record)
+
+	go func() {
+		defer close(records)
+		defer w.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case ev, ok := <-w.ResultChan():
+				if !ok || ev.Type == watch.Error {
+					return
+				}
+
+				r, ok := decode(ev.Object)
+				if !ok {
+					continue
+				}
+
+				// a deleted object is free
+				if ev.Type == watch.Deleted {
+					r = &record{}
+				}
+
+				select {
+				case records <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return records
+}
+
+func decodeLease(lease *coordinationv1.Lease) (*record, error) {
+	r := &record{
+		version: lease.ResourceVersion,
+		object:  lease,
+	}
+
+	if lease.Spec.LeaseDurationSeconds != nil {
+		r.leaseDuration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+
+	if lease.Spec.LeaseTransitions != nil {
+		r.transitions = *lease.Spec.LeaseTransitions
+	}
+
+	if err := r.decodeAnnotations(lease.Annotations); err != nil {
+		return nil, fmt.Errorf("lease %s/%s: %w", lease.Namespace, lease.Name, err)
+	}
+
+	specHolder := ""
+	if lease.Spec.HolderIdentity != nil {
+		specHolder = *lease.Spec.HolderIdentity
+	}
+
+	if joinIdentities(r.holders) == specHolder {
+
+		// for a single holder the spec times are authoritative
+		if len(r.holders) == 1 {
+			specTimes(lease, &r.holders[0])
+		}
+
+		return r, nil
+	}
+
+	// no annotation, or the spec has been changed without it,
+	// so we use the spec only
+	r.holders = nil
+	if specHolder != "" {
+		h := Holder{Identity: specHolder, Token: Token(r.transitions)}
+		specTimes(lease, &h)
+		r.holders = append(r.holders, h)
+	}
+
+	return r, nil
+}
+
+// specTimes sets the times of the holder from the lease spec
+func specTimes(lease *coordinationv1.Lease, h *Holder) {
+	if lease.Spec.AcquireTime != nil {
+		h.AcquireTime = *lease.Spec.AcquireTime
+	}
+
+	if lease.Spec.RenewTime != nil {
+		h.RenewTime = *lease.Spec.RenewTime
+	} else {
+		h.RenewTime = h.AcquireTime
+	}
+}
+
+func encodeLease(lease *coordinationv1.Lease, r *record) error {
+	if lease.Annotations == nil {
+		lease.Annotations = map[string]string{}
+	}
+
+	if err := r.encodeAnnotations(lease.Annotations); err != nil {
+		return err
+	}
+
+	transitions := r.transitions
+	lease.Spec.LeaseTransitions = &transitions
+
+	if r.leaseDuration > 0 {
+		seconds := int32((r.leaseDuration + time.Second - 1) / time.Second)
+		lease.Spec.LeaseDurationSeconds = &seconds
+	} else {
+		lease.Spec.LeaseDurationSeconds = nil
+	}
+
+	if len(r.holders) == 0 {
+		lease.Spec.HolderIdentity = nil
+		lease.Spec.AcquireTime = nil
+		lease.Spec.RenewTime = nil
+		return nil
+	}
+
+	// the spec has the earliest acquire and the latest renew time
+	identity := joinIdentities(r.holders)
+	acquireTime := r.holders[0].AcquireTime
+	renewTime := r.holders[0].RenewTime
+	for _, h := range r.holders[1:] {
+		if h.AcquireTime.Before(&acquireTime) {
+			acquireTime = h.AcquireTime
+		}
+
+		if renewTime.Before(&h.RenewTime) {
+			renewTime = h.RenewTime
+		}
+	}
+
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.AcquireTime = &acquireTime
+	lease.Spec.RenewTime = &renewTime
+	return nil
+}
@@ -0,0 +1,71 @@
+package kmutex
+
+import (
+	"context"
+	"time"
+
+	"github.com/gprossliner/xhdl"
+)
+
+// Locker is a lock held by one or more holders, identified by their identity.
+// Kmutex implements it on top of a Backend.
+type Locker interface {
+	TryAcquire(ctx xhdl.Context, info HolderInfo) (Token, bool)
+	Acquire(ctx xhdl.Context, info HolderInfo, onWait WaitFunc) Token
+	LeaveQueue(ctx xhdl.Context)
+	Release(ctx xhdl.Context)
+	ReleaseSession(ctx xhdl.Context, session string) (held bool)
+	RefreshSession(ctx xhdl.Context, session string)
+	ForceRelease(ctx xhdl.Context, identity, reason string) (Holder, bool)
+	TakeOver(ctx xhdl.Context, identity, reason string) (Holder, bool)
+	Extend(ctx xhdl.Context, d time.Duration, reason string) time.Time
+	CheckToken(ctx xhdl.Context, token Token) bool
+	CurrentOwner(ctx xhdl.Context) string
+	CurrentOwners(ctx xhdl.Context) []string
+	QueuePosition(ctx xhdl.Context) (position int, waiting int)
+	Describe(ctx xhdl.Context) Description
+	Lost() <-chan struct{}
+	LostReason() error
+}
+
+var _ Locker = &Kmutex{}
+
+// Backend stores the state of a Kmutex. Use NewLeaseBackend,
+// NewConfigMapBackend or NewMemoryBackend to create one.
+type Backend interface {
+	// get returns the record, or an empty record if it doesn't exist
+	get(ctx xhdl.Context) *record
+
+	// load returns the record to be saved, and creates it if it doesn't exist and create is set
+	load(ctx xhdl.Context, create bool) *record
+
+	// save saves the record if it hasn't been modified since loaded, and returns the
+	// new version. If it has been modified a Conflict error is returned.
+	save(ctx xhdl.Context, r *record) (string, error)
+
+	// watch returns the record for every change after version, until ctx is done
+	watch(ctx context.Context, version string) (<-chan *record, error)
+
+	String() string
+}
+
+// Description describes the state of a lock
+type Description struct {
+	// Backend describes where the lock is stored
+	Backend string
+
+	// Holders are the current holders
+	Holders []Holder
+
+	// Waiters are the waiters in the queue, in order
+	Waiters []Ticket
+
+	// LastForceRelease is the last hold broken by ForceRelease, nil if none
+	LastForceRelease *ForceRelease
+
+	// Token is the fencing token of the latest acquisition
+	Token Token
+
+	// LeaseDuration is the time after which a holder not renewed is considered expired
+	LeaseDuration time.Duration
+}
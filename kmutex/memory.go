@@ -0,0 +1,108 @@
+package kmutex
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/gprossliner/xhdl"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// MemoryBackend stores the record in memory. It can be shared by multiple
+// Kmutex instances of the same process, which is useful for tests and for
+// using suss as a library without a Kubernetes API server.
+type MemoryBackend struct {
+	mu       sync.Mutex
+	rec      *record
+	version  int
+	watchers map[chan *record]struct{}
+}
+
+// NewMemoryBackend returns a new empty MemoryBackend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		rec:      &record{},
+		watchers: map[chan *record]struct{}{},
+	}
+}
+
+func (b *MemoryBackend) String() string {
+	return fmt.Sprintf("memory %p", b)
+}
+
+func (b *MemoryBackend) get(ctx xhdl.Context) *record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r := b.rec.clone()
+	r.version = strconv.Itoa(b.version)
+	return r
+}
+
+func (b *MemoryBackend) load(ctx xhdl.Context, create bool) *record {
+	return b.get(ctx)
+}
+
+func (b *MemoryBackend) save(ctx xhdl.Context, r *record) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r.version != strconv.Itoa(b.version) {
+		return "", errors.NewConflict(schema.GroupResource{Resource: "memory"}, b.String(), fmt.Errorf("record has been modified"))
+	}
+
+	b.rec = r.clone()
+	b.version++
+
+	// watchers only get the latest record, if they haven't consumed the last one
+	for w := range b.watchers {
+		select {
+		case <-w:
+		default:
+		}
+		w <- b.rec.clone()
+	}
+
+	return strconv.Itoa(b.version), nil
+}
+
+func (b *MemoryBackend) watch(ctx context.Context, version string) (<-chan *record, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	w := make(chan *record, 1)
+	b.watchers[w] = struct{}{}
+
+	// changes since version
+	if version != strconv.Itoa(b.version) {
+		w <- b.rec.clone()
+	}
+
+	records := make(chan *record)
+	go func() {
+		defer close(records)
+		defer func() {
+			b.mu.Lock()
+			delete(b.watchers, w)
+			b.mu.Unlock()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case r := <-w:
+				select {
+				case records <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return records, nil
+}
@@ -0,0 +1,34 @@
+package kmutex
+
+import "time"
+
+// Observer gets notified about the transitions of a Kmutex, e.g. for metrics.
+// lock is the Backend of the Kmutex, as returned by its String method. The
+// methods are called synchronously after the change has been saved, and
+// must not block.
+type Observer interface {
+	// AcquireAttempt is called for every try to acquire the lock, also while waiting in Acquire
+	AcquireAttempt(lock, identity string)
+
+	// Acquired is called if the lock has been acquired, wait is the time
+	// since identity has been queued, 0 if it wasn't queued
+	Acquired(lock, identity string, token Token, wait time.Duration)
+
+	// ConflictRetry is called if an update of the lock is retried, because
+	// it has been modified concurrently
+	ConflictRetry(lock string, retry int, err error)
+
+	// Released is called if the lock has been released by its holder
+	Released(lock, identity string, token Token)
+
+	// TakenOver is called if the hold of another holder has been removed by
+	// identity, because it expired or has been force released
+	TakenOver(lock string, previous Holder, identity, reason string)
+}
+
+// observe calls fn with the Observer, if set
+func (km *Kmutex) observe(fn func(o Observer, lock string)) {
+	if km.Observer != nil {
+		fn(km.Observer, km.backend().String())
+	}
+}
@@ -0,0 +1,428 @@
+package kmutex
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	annotationPrefix  = "kmutex.world-direct.at/"
+	annotationHolders = annotationPrefix + "holders"
+	annotationQueue   = annotationPrefix + "queue"
+
+	annotationForceRelease = annotationPrefix + "lastForceRelease"
+)
+
+// Token is a fencing token, increased with every acquisition of the lock
+type Token int64
+
+// HolderInfo is informational metadata recorded for a holder on acquisition
+type HolderInfo struct {
+	// Version is the version of the software acquiring the lock
+	Version string `json:"version,omitempty"`
+
+	// Session identifies the request or session that acquired the lock
+	Session string `json:"session,omitempty"`
+
+	// Reason is a free text why the lock has been acquired
+	Reason string `json:"reason,omitempty"`
+
+	// Client identifies the caller, like the name of the script
+	Client string `json:"client,omitempty"`
+}
+
+// Holder is a single holder of the lock
+type Holder struct {
+	Identity    string           `json:"identity"`
+	Token       Token            `json:"token"`
+	AcquireTime metav1.MicroTime `json:"acquireTime"`
+	RenewTime   metav1.MicroTime `json:"renewTime"`
+	HolderInfo
+
+	// Exclusive is set if the lock is held exclusively
+	Exclusive bool `json:"exclusive,omitempty"`
+
+	// Domain is the topology domain of the holder, see Kmutex.Domain
+	Domain string `json:"domain,omitempty"`
+
+	// Deadline is the time the hold is overdue, nil if it has no deadline.
+	// See MaxHoldDuration and Extend.
+	Deadline *metav1.MicroTime `json:"deadline,omitempty"`
+
+	// Extensions are the extensions of the deadline, see Extend
+	Extensions []Extension `json:"extensions,omitempty"`
+
+	// Sessions are the sessions of the holder that acquired the lock and
+	// have not released it yet, see ReleaseSession
+	Sessions []Session `json:"sessions,omitempty"`
+}
+
+// Extension records an extension of the deadline of a hold
+type Extension struct {
+	Time   metav1.MicroTime `json:"time"`
+	Reason string           `json:"reason"`
+}
+
+// Overdue returns true if the hold has a deadline, which has passed
+func (h Holder) Overdue(now time.Time) bool {
+	return h.Deadline != nil && now.After(h.Deadline.Time)
+}
+
+// Session is an acquisition of the lock by a holder already holding it,
+// identified by HolderInfo.Session
+type Session struct {
+	HolderInfo
+	AcquireTime metav1.MicroTime `json:"acquireTime"`
+
+	// RefreshTime is the last time the session has been acquired or
+	// refreshed, see Kmutex.RefreshSession
+	RefreshTime metav1.MicroTime `json:"refreshTime,omitempty"`
+
+	// Timeout is the time after which the session expires if not refreshed,
+	// 0 if it doesn't expire. See Kmutex.SessionTimeout.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+}
+
+// Expired returns true if the session has not been refreshed within its Timeout
+func (s Session) Expired(now time.Time) bool {
+	if s.Timeout.Duration <= 0 {
+		return false
+	}
+
+	refreshed := s.RefreshTime
+	if refreshed.IsZero() {
+		refreshed = s.AcquireTime
+	}
+
+	return now.After(refreshed.Add(s.Timeout.Duration))
+}
+
+// session returns the index of the session with the given id, or -1
+func (h Holder) session(id string) int {
+	for i, s := range h.Sessions {
+		if s.Session == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Ticket is a waiter in the queue of the lock
+type Ticket struct {
+	Identity    string           `json:"identity"`
+	EnqueueTime metav1.MicroTime `json:"enqueueTime"`
+	RefreshTime metav1.MicroTime `json:"refreshTime"`
+
+	// Exclusive is set if the waiter wants to hold the lock exclusively
+	Exclusive bool `json:"exclusive,omitempty"`
+
+	// Domain is the topology domain of the waiter, see Kmutex.Domain
+	Domain string `json:"domain,omitempty"`
+}
+
+// ForceRelease records who broke the hold of another holder, and why
+type ForceRelease struct {
+	Holder Holder           `json:"holder"`
+	By     string           `json:"by"`
+	Reason string           `json:"reason"`
+	Time   metav1.MicroTime `json:"time"`
+}
+
+// record is the state of the lock, loaded from and saved to a Backend.
+//
+// The holders are stored as json in the annotationHolders annotation,
+// the waiters in order in the annotationQueue annotation, and the
+// last forced release in the annotationForceRelease annotation.
+type record struct {
+	holders       []Holder
+	queue         []Ticket
+	forceRelease  *ForceRelease
+	leaseDuration time.Duration
+	transitions   int32
+
+	// version is the version of the object the record was loaded from,
+	// and object the object itself, both used by the Backend to save it
+	version string
+	object  any
+}
+
+// decodeAnnotations sets the fields stored in annotations from them
+func (r *record) decodeAnnotations(annotations map[string]string) error {
+	if v, found := annotations[annotationHolders]; found {
+		if err := json.Unmarshal([]byte(v), &r.holders); err != nil {
+			return fmt.Errorf("invalid annotation %s: %w", annotationHolders, err)
+		}
+	}
+
+	if v, found := annotations[annotationQueue]; found {
+		if err := json.Unmarshal([]byte(v), &r.queue); err != nil {
+			return fmt.Errorf("invalid annotation %s: %w", annotationQueue, err)
+		}
+	}
+
+	if v, found := annotations[annotationForceRelease]; found {
+		r.forceRelease = &ForceRelease{}
+		if err := json.Unmarshal([]byte(v), r.forceRelease); err != nil {
+			return fmt.Errorf("invalid annotation %s: %w", annotationForceRelease, err)
+		}
+	}
+
+	return nil
+}
+
+// encodeAnnotations writes the fields stored in annotations to them
+func (r *record) encodeAnnotations(annotations map[string]string) error {
+	holders, err := json.Marshal(r.holders)
+	if err != nil {
+		return err
+	}
+
+	queue, err := json.Marshal(r.queue)
+	if err != nil {
+		return err
+	}
+
+	annotations[annotationHolders] = string(holders)
+	annotations[annotationQueue] = string(queue)
+
+	if r.forceRelease != nil {
+		forceRelease, err := json.Marshal(r.forceRelease)
+		if err != nil {
+			return err
+		}
+		annotations[annotationForceRelease] = string(forceRelease)
+	}
+
+	return nil
+}
+
+// equal returns true if both records have the same state
+func (r *record) equal(o *record) bool {
+	ra, oa := map[string]string{}, map[string]string{}
+	if r.encodeAnnotations(ra) != nil || o.encodeAnnotations(oa) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(ra, oa) && r.leaseDuration == o.leaseDuration && r.transitions == o.transitions
+}
+
+// clone returns a deep copy of the record
+func (r *record) clone() *record {
+	c := *r
+	c.holders = append([]Holder(nil), r.holders...)
+	for i := range c.holders {
+		c.holders[i].Sessions = append([]Session(nil), c.holders[i].Sessions...)
+		c.holders[i].Extensions = append([]Extension(nil), c.holders[i].Extensions...)
+	}
+	c.queue = append([]Ticket(nil), r.queue...)
+	return &c
+}
+
+func joinIdentities(holders []Holder) string {
+	var ids []string
+	for _, h := range holders {
+		ids = append(ids, h.Identity)
+	}
+
+	return strings.Join(ids, ",")
+}
+
+// expired returns true if the holder has not renewed within the leaseDuration.
+// If there is no leaseDuration, or the holder has never renewed, it doesn't expire.
+func (r *record) expired(h Holder, now time.Time) bool {
+	if r.leaseDuration <= 0 || h.RenewTime.IsZero() {
+		return false
+	}
+
+	return now.After(h.RenewTime.Add(r.leaseDuration))
+}
+
+// prune removes expired holders, and returns them
+func (r *record) prune(now time.Time) (expired []Holder) {
+	var holders []Holder
+	for _, h := range r.holders {
+		if r.expired(h, now) {
+			expired = append(expired, h)
+		} else {
+			holders = append(holders, h)
+		}
+	}
+
+	r.holders = holders
+	return
+}
+
+// pruneSessions removes expired sessions, and the holders whose last session
+// has expired, and returns these holders. Holders without sessions are kept.
+func (r *record) pruneSessions(now time.Time) (expired []Holder) {
+	var holders []Holder
+	for _, h := range r.holders {
+		if len(h.Sessions) == 0 {
+			holders = append(holders, h)
+			continue
+		}
+
+		var sessions []Session
+		for _, s := range h.Sessions {
+			if !s.Expired(now) {
+				sessions = append(sessions, s)
+			}
+		}
+
+		if len(sessions) == 0 {
+			expired = append(expired, h)
+			continue
+		}
+
+		h.Sessions = sessions
+		holders = append(holders, h)
+	}
+
+	r.holders = holders
+	return
+}
+
+// holder returns the index of the holder with the given identity, or -1
+func (r *record) holder(identity string) int {
+	for i, h := range r.holders {
+		if h.Identity == identity {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// owners returns the identities of all holders not expired
+func (r *record) owners(now time.Time) []string {
+	var owners []string
+	for _, h := range r.holders {
+		if !r.expired(h, now) {
+			owners = append(owners, h.Identity)
+		}
+	}
+
+	return owners
+}
+
+// ticket returns the index of the ticket with the given identity, or -1
+func (r *record) ticket(identity string) int {
+	for i, t := range r.queue {
+		if t.Identity == identity {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// enqueue adds a ticket for identity if not already queued, refreshes
+// it and returns its index in the queue
+func (r *record) enqueue(identity string, exclusive bool, domain string, now time.Time) int {
+	i := r.ticket(identity)
+	if i < 0 {
+		r.queue = append(r.queue, Ticket{
+			Identity:    identity,
+			EnqueueTime: metav1.NewMicroTime(now),
+			Exclusive:   exclusive,
+			Domain:      domain,
+		})
+		i = len(r.queue) - 1
+	}
+
+	r.queue[i].RefreshTime = metav1.NewMicroTime(now)
+	return i
+}
+
+// requeue puts a ticket for identity at the head of the queue
+func (r *record) requeue(identity string, exclusive bool, domain string, now time.Time) {
+	r.dequeue(identity)
+	r.queue = append([]Ticket{{
+		Identity:    identity,
+		EnqueueTime: metav1.NewMicroTime(now),
+		RefreshTime: metav1.NewMicroTime(now),
+		Exclusive:   exclusive,
+		Domain:      domain,
+	}}, r.queue...)
+}
+
+// slot returns the position of the ticket at position among the waiters that
+// may get the lock. Waiters of a domain held by a holder or by a waiter before
+// them are skipped, and blocked is true if the ticket itself is one of them.
+func (r *record) slot(position int) (slot int, blocked bool) {
+	busy := map[string]bool{}
+	for _, h := range r.holders {
+		if h.Domain != "" {
+			busy[h.Domain] = true
+		}
+	}
+
+	for i, t := range r.queue[:position+1] {
+		if busy[t.Domain] {
+			if i == position {
+				return 0, true
+			}
+			continue
+		}
+
+		if t.Domain != "" {
+			busy[t.Domain] = true
+		}
+		if i == position {
+			return slot, false
+		}
+		slot++
+	}
+
+	return slot, false
+}
+
+// exclusive returns true if the lock is held exclusively
+func (r *record) exclusive() bool {
+	for _, h := range r.holders {
+		if h.Exclusive {
+			return true
+		}
+	}
+
+	return false
+}
+
+// exclusiveWaiting returns true if an exclusive waiter is queued before position
+func (r *record) exclusiveWaiting(position int) bool {
+	for _, t := range r.queue[:position] {
+		if t.Exclusive {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dequeue removes the ticket of identity from the queue
+func (r *record) dequeue(identity string) {
+	if i := r.ticket(identity); i >= 0 {
+		r.queue = append(r.queue[:i], r.queue[i+1:]...)
+	}
+}
+
+// evict removes tickets not refreshed within timeout, and returns them
+func (r *record) evict(now time.Time, timeout time.Duration) (evicted []Ticket) {
+	var queue []Ticket
+	for _, t := range r.queue {
+		if now.After(t.RefreshTime.Add(timeout)) {
+			evicted = append(evicted, t)
+		} else {
+			queue = append(queue, t)
+		}
+	}
+
+	r.queue = queue
+	return
+}
@@ -5,11 +5,17 @@ import (
 
 	"github.com/gprossliner/xhdl"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 )
 
 // Loop enters a retry-loop with cancelation support
 // return true from the fn function to exit the loop
 func Loop(ctx xhdl.Context, sleep time.Duration, fn func(ctx xhdl.Context) (exit bool)) {
+	LoopWithClock(ctx, clock.RealClock{}, sleep, fn)
+}
+
+// LoopWithClock is Loop, using clk to sleep
+func LoopWithClock(ctx xhdl.Context, clk clock.Clock, sleep time.Duration, fn func(ctx xhdl.Context) (exit bool)) {
 
 	for {
 		exit := fn(ctx)
@@ -17,13 +23,14 @@ func Loop(ctx xhdl.Context, sleep time.Duration, fn func(ctx xhdl.Context) (exit
 			return
 		}
 
-		timer := time.NewTimer(sleep)
+		timer := clk.NewTimer(sleep)
 		select {
 		case <-ctx.Done():
+			timer.Stop()
 			klog.Info("Context has been cancled")
 			return
 
-		case <-timer.C:
+		case <-timer.C():
 			continue
 		}
 	}
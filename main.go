@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"time"
+	_ "time/tzdata" // the time zones of the maintenance windows, the image has none
 
 	"github.com/gprossliner/xhdl"
+	"github.com/world-direct/kmutex"
 	"github.com/world-direct/suss"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -23,6 +32,24 @@ var (
 	fLeaseNamespace               string
 	fConsiderSoleReplicasCritical bool
 	fConsiderStatefulSetCritical  bool
+	fLeaseDuration                time.Duration
+	fSessionTimeout               time.Duration
+	fMaxHolders                   int
+	fLockBackend                  string
+	fStaleHolderThreshold         time.Duration
+	fMaxHoldDuration              time.Duration
+	fOverduePolicy                string
+	fCoordinationKubeConfig       string
+	fCoordinationNamespace        string
+	fCoordinationMode             string
+	fClusterName                  string
+	fMaintenanceWindows           string
+	fWindowPolicy                 string
+	fUpdateDuration               time.Duration
+	fClusterHealthCheck           bool
+	fCapacityCheck                string
+	fTopologyLabel                string
+	fNodeGroups                   string
 
 	service suss.Service
 )
@@ -34,6 +61,24 @@ func main() {
 	flag.StringVar(&fLeaseNamespace, "leasenamespace", "", "the namespace for the lease, can be set by the NAMESPACE envvar")
 	flag.BoolVar(&fConsiderStatefulSetCritical, "considerStatefulSetCritical", false, "all pods part of a statefulset are critical")
 	flag.BoolVar(&fConsiderSoleReplicasCritical, "considerSoleReplicasCritical", false, "all pods part of a replicaset with only one replica are critical")
+	flag.IntVar(&fMaxHolders, "maxHolders", 1, "number of nodes that may hold the lock, and so be updated, at the same time")
+	flag.StringVar(&fLockBackend, "lockBackend", "lease", "where to store the lock, 'lease' or 'configmap'")
+	flag.DurationVar(&fLeaseDuration, "leaseDuration", 0, "time after which a lease not renewed by its holder is considered free, 0 to never expire")
+	flag.DurationVar(&fSessionTimeout, "sessionTimeout", 0, "time after which a session not refreshed by /refresh or the other commands expires, releasing the lease with the last session, 0 to never expire")
+	flag.DurationVar(&fMaxHoldDuration, "maxHoldDuration", 0, "time a node may hold the lease unless extended by /extend, 0 for no limit")
+	flag.StringVar(&fOverduePolicy, "overduePolicy", suss.OverduePolicyEscalate, "what to do with an overdue hold, 'escalate' or 'release'")
+	flag.StringVar(&fCoordinationKubeConfig, "coordinationKubeconfig", "", "kubeconfig of a coordination cluster to share the lock with other clusters, not shared if not set")
+	flag.StringVar(&fCoordinationNamespace, "coordinationNamespace", "", "the namespace for the lock in the coordination cluster, defaults to the lease namespace")
+	flag.StringVar(&fCoordinationMode, "coordinationMode", "additional", "how to use the lock of the coordination cluster, 'additional' to the lock of this cluster or 'instead' of it")
+	flag.StringVar(&fClusterName, "clusterName", "", "the name of this cluster, required with --coordinationKubeconfig")
+	flag.StringVar(&fMaintenanceWindows, "maintenanceWindows", "", "times nodes may be updated in, separated by ';', e.g. 'Mon-Fri 01:00-05:00 Europe/Vienna', always if not set")
+	flag.StringVar(&fWindowPolicy, "windowPolicy", suss.WindowPolicyWait, "what /synchronize does outside of a maintenance window, 'wait' or 'refuse'")
+	flag.DurationVar(&fUpdateDuration, "updateDuration", 0, "expected time of an update, which needs to end within the maintenance window, defaults to maxHoldDuration")
+	flag.BoolVar(&fClusterHealthCheck, "clusterHealthCheck", false, "wait in /synchronize until all other nodes are Ready, reachable and not cordoned")
+	flag.StringVar(&fCapacityCheck, "capacityCheck", suss.CapacityCheckOff, "check if the critical pods fit on the other nodes before /teardown, 'off', 'warn' or 'refuse'")
+	flag.StringVar(&fTopologyLabel, "topologyLabel", "", "label of the topology domain of the nodes, e.g. 'topology.kubernetes.io/zone', at most one node per domain is updated at the same time")
+	flag.StringVar(&fNodeGroups, "nodeGroups", "", "groups of nodes with their own lock and limit, separated by ';', e.g. 'workers 10% !node-role.kubernetes.io/control-plane'")
+	flag.DurationVar(&fStaleHolderThreshold, "staleHolderThreshold", 0, "time after which the lease of a NotReady holder node is taken over, 0 to never take it over")
 
 	// klog.InitFlags(flag.CommandLine)
 	flag.Parse()
@@ -48,11 +93,35 @@ func main() {
 	http.HandleFunc("/healthz", cmdHealthz)
 	http.HandleFunc("/logstream", cmdLogStream)
 	http.HandleFunc("/criticalpods", cmdCriticalPods)
+	http.HandleFunc("/lockstatus", cmdLockStatus)
 
-	registerCommand("synchronize", func(ctx xhdl.Context) { service.Synchronize(ctx) })
-	registerCommand("teardown", func(ctx xhdl.Context) { service.Teardown(ctx) })
-	registerCommand("release", func(ctx xhdl.Context) { service.Release(ctx) })
-	registerCommand("releasedelayed", func(ctx xhdl.Context) { service.ReleaseDelayed(ctx) })
+	registerCommand("synchronize", func(ctx xhdl.Context) {
+		service.Synchronize(ctx, queryParam(ctx, "reason"), queryParam(ctx, "client"), queryParam(ctx, "session"))
+	})
+	registerCommand("cluster/synchronize", func(ctx xhdl.Context) {
+		service.SynchronizeCluster(ctx, queryParam(ctx, "operation"), queryParam(ctx, "reason"), queryParam(ctx, "client"))
+	})
+	registerCommand("cluster/release", func(ctx xhdl.Context) {
+		service.ReleaseCluster(ctx, queryParam(ctx, "operation"), queryParam(ctx, "session"))
+	})
+	registerCommand("teardown", func(ctx xhdl.Context) {
+		service.Teardown(ctx, tokenParam(ctx), queryParam(ctx, "session"))
+	})
+	registerCommand("release", func(ctx xhdl.Context) {
+		service.Release(ctx, tokenParam(ctx), queryParam(ctx, "session"))
+	})
+	registerCommand("releasedelayed", func(ctx xhdl.Context) {
+		service.ReleaseDelayed(ctx, tokenParam(ctx), queryParam(ctx, "session"))
+	})
+	registerCommand("extend", func(ctx xhdl.Context) {
+		service.Extend(ctx, tokenParam(ctx), queryParam(ctx, "session"), durationParam(ctx), queryParam(ctx, "reason"))
+	})
+	registerCommand("refresh", func(ctx xhdl.Context) {
+		service.Refresh(ctx, tokenParam(ctx), queryParam(ctx, "session"))
+	})
+	registerCommand("admin/forcerelease", func(ctx xhdl.Context) {
+		service.ForceRelease(ctx, queryParam(ctx, "node"), queryParam(ctx, "reason"))
+	})
 	registerCommand("testfail", func(ctx xhdl.Context) { service.TestFail(ctx) })
 
 	klog.Infof("listen on %s\n", fBindAddress)
@@ -75,7 +144,13 @@ func getCommandHandler(name string, fn func(ctx xhdl.Context)) http.HandlerFunc
 		sink := defaultlog.GetSink()
 		ctxlog := defaultlog.WithSink(rwsink{sink})
 
+		// the output of the command is buffered, so that we can
+		// still return an error status code
+		var output bytes.Buffer
+
 		myctx := klog.NewContext(r.Context(), ctxlog)
+		myctx = suss.WithOutput(myctx, &output)
+		myctx = context.WithValue(myctx, requestKey{}, r)
 		err := xhdl.RunContext(myctx, func(ctx xhdl.Context) {
 			fn(ctx)
 		})
@@ -84,12 +159,57 @@ func getCommandHandler(name string, fn func(ctx xhdl.Context)) http.HandlerFunc
 			klog.Error(err.Error())
 
 			w.WriteHeader(500)
+			w.Write(output.Bytes())
 			io.WriteString(w, err.Error())
 
+		} else {
+			w.Write(output.Bytes())
 		}
 	}
 }
 
+type requestKey struct{}
+
+// queryParam returns the query parameter of the command request
+func queryParam(ctx xhdl.Context, name string) string {
+	r, ok := ctx.Value(requestKey{}).(*http.Request)
+	if !ok {
+		return ""
+	}
+
+	return r.URL.Query().Get(name)
+}
+
+// tokenParam returns the fencing token passed by the token query parameter, 0 if not set
+func tokenParam(ctx xhdl.Context) kmutex.Token {
+	v := queryParam(ctx, "token")
+	if v == "" {
+		return 0
+	}
+
+	token, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		ctx.Throw(fmt.Errorf("invalid token %q: %w", v, err))
+	}
+
+	return kmutex.Token(token)
+}
+
+// durationParam returns the duration passed by the duration query parameter, 0 if not set
+func durationParam(ctx xhdl.Context) time.Duration {
+	v := queryParam(ctx, "duration")
+	if v == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		ctx.Throw(fmt.Errorf("invalid duration %q: %w", v, err))
+	}
+
+	return d
+}
+
 func registerCommand(name string, fn func(ctx xhdl.Context)) {
 	http.HandleFunc("/"+name, getCommandHandler(name, fn))
 }
@@ -120,6 +240,119 @@ func initService(ctx xhdl.Context) {
 
 	klog.Infof("using namespace %s for the Lease", fLeaseNamespace)
 
+	// the uid of our node is part of the lock identity
+	node, err := k8s.CoreV1().Nodes().Get(ctx, fNodeName, metav1.GetOptions{})
+	ctx.Throw(err)
+
+	// node group of our node, with its own lock and limit
+	lockName, nodeGroup := "sync", ""
+	nodeGroups, err := suss.ParseNodeGroups(fNodeGroups)
+	ctx.Throw(err)
+
+	if len(nodeGroups) > 0 {
+		if group, found := suss.SelectNodeGroup(nodeGroups, node); !found {
+			klog.Warningf("node %s belongs to no node group, using the %s lock", fNodeName, lockName)
+		} else {
+			lockName, nodeGroup = group.LockName(), group.Name
+			klog.Infof("using node group %v", group)
+		}
+	}
+
+	// lock backend
+	newBackend := func(client kubernetes.Interface, namespace, name string) kmutex.Backend {
+		if fLockBackend == "configmap" {
+			return kmutex.NewConfigMapBackend(client, namespace, name)
+		}
+		return kmutex.NewLeaseBackend(client, namespace, name)
+	}
+
+	if fLockBackend != "lease" && fLockBackend != "configmap" {
+		ctx.Throw(fmt.Errorf("invalid --lockBackend %q, must be 'lease' or 'configmap'", fLockBackend))
+	}
+
+	lockBackend := newBackend(k8s, fLeaseNamespace, lockName)
+
+	// cluster operations lock all groups, and the nodes in no group,
+	// starting with the lock of our node
+	clusterLockNames := []string{lockName}
+	addClusterLock := func(name string) {
+		if !slices.Contains(clusterLockNames, name) {
+			clusterLockNames = append(clusterLockNames, name)
+		}
+	}
+
+	addClusterLock("sync")
+	for _, g := range nodeGroups {
+		addClusterLock(g.LockName())
+	}
+
+	var clusterLockBackends []kmutex.Backend
+	for _, name := range clusterLockNames {
+		clusterLockBackends = append(clusterLockBackends, newBackend(k8s, fLeaseNamespace, name))
+	}
+
+	// lock shared with other clusters
+	var coordinationBackend kmutex.Backend
+	if fCoordinationKubeConfig != "" {
+		if fClusterName == "" {
+			ctx.Throw(fmt.Errorf("--clusterName required with --coordinationKubeconfig"))
+		}
+
+		if fCoordinationNamespace == "" {
+			fCoordinationNamespace = fLeaseNamespace
+		}
+
+		klog.Infof("using coordination cluster of %s, namespace %s for the lock", fCoordinationKubeConfig, fCoordinationNamespace)
+
+		coordinationConfig, err := clientcmd.BuildConfigFromFlags("", fCoordinationKubeConfig)
+		ctx.Throw(err)
+
+		coordination := kubernetes.NewForConfigOrDie(coordinationConfig)
+		coordinationBackend = newBackend(coordination, fCoordinationNamespace, lockName)
+
+		switch fCoordinationMode {
+		case "additional":
+		case "instead":
+			// the limit of the node group would be another one in each cluster
+			lockBackend, coordinationBackend, nodeGroup = coordinationBackend, nil, ""
+			for i, name := range clusterLockNames {
+				clusterLockBackends[i] = newBackend(coordination, fCoordinationNamespace, name)
+			}
+		default:
+			ctx.Throw(fmt.Errorf("invalid --coordinationMode %q, must be 'additional' or 'instead'", fCoordinationMode))
+		}
+	}
+
+	if fOverduePolicy != suss.OverduePolicyEscalate && fOverduePolicy != suss.OverduePolicyRelease {
+		ctx.Throw(fmt.Errorf("invalid --overduePolicy %q, must be '%s' or '%s'", fOverduePolicy, suss.OverduePolicyEscalate, suss.OverduePolicyRelease))
+	}
+
+	if fWindowPolicy != suss.WindowPolicyWait && fWindowPolicy != suss.WindowPolicyRefuse {
+		ctx.Throw(fmt.Errorf("invalid --windowPolicy %q, must be '%s' or '%s'", fWindowPolicy, suss.WindowPolicyWait, suss.WindowPolicyRefuse))
+	}
+
+	if fCapacityCheck != suss.CapacityCheckOff && fCapacityCheck != suss.CapacityCheckWarn && fCapacityCheck != suss.CapacityCheckRefuse {
+		ctx.Throw(fmt.Errorf("invalid --capacityCheck %q, must be '%s', '%s' or '%s'", fCapacityCheck, suss.CapacityCheckOff, suss.CapacityCheckWarn, suss.CapacityCheckRefuse))
+	}
+
+	maintenanceWindows, err := suss.ParseMaintenanceWindows(fMaintenanceWindows)
+	ctx.Throw(err)
+
+	for _, w := range maintenanceWindows {
+		klog.Infof("maintenance window %v", w)
+	}
+
+	// topology domain of our node
+	var topologyDomain string
+	if fTopologyLabel != "" {
+		topologyDomain = node.Labels[fTopologyLabel]
+		if topologyDomain == "" {
+			klog.Warningf("node %s has no label %s, not restricted to one node per topology domain", fNodeName, fTopologyLabel)
+		} else {
+			klog.Infof("using topology domain %s", topologyDomain)
+		}
+	}
+
 	// init options
 	opt := suss.SussOptions{
 		NodeName:                     fNodeName,
@@ -127,6 +360,27 @@ func initService(ctx xhdl.Context) {
 		K8s:                          k8s,
 		ConsiderStatefulSetCritical:  fConsiderStatefulSetCritical,
 		ConsiderSoleReplicasCritical: fConsiderSoleReplicasCritical,
+		LeaseDuration:                fLeaseDuration,
+		SessionTimeout:               fSessionTimeout,
+		MaxHolders:                   fMaxHolders,
+		LockName:                     lockName,
+		NodeGroups:                   nodeGroups,
+		NodeGroup:                    nodeGroup,
+		LockBackend:                  lockBackend,
+		ClusterLockBackends:          clusterLockBackends,
+		Version:                      VERSION,
+		StaleHolderThreshold:         fStaleHolderThreshold,
+		NodeUID:                      node.UID,
+		MaxHoldDuration:              fMaxHoldDuration,
+		OverduePolicy:                fOverduePolicy,
+		CoordinationBackend:          coordinationBackend,
+		ClusterName:                  fClusterName,
+		MaintenanceWindows:           maintenanceWindows,
+		WindowPolicy:                 fWindowPolicy,
+		UpdateDuration:               fUpdateDuration,
+		ClusterHealthCheck:           fClusterHealthCheck,
+		CapacityCheck:                fCapacityCheck,
+		TopologyDomain:               topologyDomain,
 	}
 
 	// and create service
@@ -188,3 +442,67 @@ func cmdCriticalPods(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(500)
 	}
 }
+
+func cmdLockStatus(w http.ResponseWriter, r *http.Request) {
+	err := xhdl.RunContext(r.Context(), func(ctx xhdl.Context) {
+		desc := service.LockStatus(ctx)
+
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			ctx.Throw(json.NewEncoder(w).Encode(desc))
+			return
+		}
+
+		writeLockStatus(w, desc, time.Now())
+	})
+
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+	}
+}
+
+// writeLockStatus writes the holders and waiters of the lock as text
+func writeLockStatus(w io.Writer, desc kmutex.Description, now time.Time) {
+	since := func(t metav1.MicroTime) string {
+		return fmt.Sprintf("%s (%v ago)", t.UTC().Format(time.RFC3339), now.Sub(t.Time).Round(time.Second))
+	}
+
+	fmt.Fprintf(w, "lock: %s\n", desc.Backend)
+	fmt.Fprintf(w, "token: %d\n", desc.Token)
+
+	fmt.Fprintf(w, "holders: %d\n", len(desc.Holders))
+	for _, h := range desc.Holders {
+		fmt.Fprintf(w, "* %s token=%d acquired=%s renewed=%s", h.Identity, h.Token, since(h.AcquireTime), since(h.RenewTime))
+		if h.Exclusive {
+			fmt.Fprintf(w, " exclusive")
+		}
+		if h.Domain != "" {
+			fmt.Fprintf(w, " domain=%s", h.Domain)
+		}
+		if h.Deadline != nil {
+			fmt.Fprintf(w, " deadline=%s", h.Deadline.UTC().Format(time.RFC3339))
+		}
+		fmt.Fprintln(w)
+
+		for _, s := range h.Sessions {
+			fmt.Fprintf(w, "  session %s acquired=%s reason=%q client=%q\n", s.Session, since(s.AcquireTime), s.Reason, s.Client)
+		}
+	}
+
+	fmt.Fprintf(w, "waiters: %d\n", len(desc.Waiters))
+	for i, t := range desc.Waiters {
+		fmt.Fprintf(w, "%d. %s waiting=%s heartbeat=%s", i+1, t.Identity, since(t.EnqueueTime), since(t.RefreshTime))
+		if t.Exclusive {
+			fmt.Fprintf(w, " exclusive")
+		}
+		if t.Domain != "" {
+			fmt.Fprintf(w, " domain=%s", t.Domain)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if fr := desc.LastForceRelease; fr != nil {
+		fmt.Fprintf(w, "last force release: %s by %s at %s: %s\n", fr.Holder.Identity, fr.By, fr.Time.UTC().Format(time.RFC3339), fr.Reason)
+	}
+}
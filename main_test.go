@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gprossliner/xhdl"
 	"github.com/stretchr/testify/assert"
+	"github.com/world-direct/kmutex"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
 )
 
@@ -41,3 +45,43 @@ func TestSucceededCommandsReturnHTTP200(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 	assert.Equal(t, 200, rr.Result().StatusCode)
 }
+
+func TestWriteLockStatus(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) metav1.MicroTime {
+		return metav1.NewMicroTime(now.Add(-d))
+	}
+
+	desc := kmutex.Description{
+		Backend: "lease suss/sync",
+		Token:   3,
+		Holders: []kmutex.Holder{{
+			Identity:    "node1/uid1",
+			Token:       3,
+			AcquireTime: at(time.Hour),
+			RenewTime:   at(time.Second),
+			Sessions: []kmutex.Session{{
+				HolderInfo:  kmutex.HolderInfo{Session: "1234", Reason: "os-update", Client: "update.sh"},
+				AcquireTime: at(time.Hour),
+			}},
+		}},
+		Waiters: []kmutex.Ticket{{
+			Identity:    "node2/uid2",
+			EnqueueTime: at(10 * time.Minute),
+			RefreshTime: at(5 * time.Second),
+			Domain:      "zone-a",
+		}},
+	}
+
+	var b bytes.Buffer
+	writeLockStatus(&b, desc, now)
+
+	assert.Equal(t, `lock: lease suss/sync
+token: 3
+holders: 1
+* node1/uid1 token=3 acquired=2024-05-01T11:00:00Z (1h0m0s ago) renewed=2024-05-01T11:59:59Z (1s ago)
+  session 1234 acquired=2024-05-01T11:00:00Z (1h0m0s ago) reason="os-update" client="update.sh"
+waiters: 1
+1. node2/uid2 waiting=2024-05-01T11:50:00Z (10m0s ago) heartbeat=2024-05-01T11:59:55Z (5s ago) domain=zone-a
+`, b.String())
+}
@@ -2,6 +2,7 @@ package suss
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/gprossliner/xhdl"
 	appsv1 "k8s.io/api/apps/v1"
@@ -167,13 +168,23 @@ func (ns NodeSet) OwnNode() Node {
 }
 
 func (ns NodeSet) GetNode(name string) Node {
+	node, found := ns.FindNode(name)
+	if !found {
+		panic("node no longer available, can't continue")
+	}
+
+	return node
+}
+
+// FindNode returns the node with the name, and false if it doesn't exist
+func (ns NodeSet) FindNode(name string) (Node, bool) {
 	for _, node := range ns.nodes {
 		if node.Name() == name {
-			return node
+			return node, true
 		}
 	}
 
-	panic("node no longer available, can't continue")
+	return Node{}, false
 }
 
 // sets the Label for a node. If value is am empty string the label is deleted
@@ -196,13 +207,32 @@ func (n Node) GetLabel(ctx xhdl.Context, name string) string {
 	return n.node.Labels[name]
 }
 
-// Cordoned marks the node as schedulable
+// NotReadySince returns the time since the node is not Ready, and false if it is Ready
+func (n Node) NotReadySince() (time.Time, bool) {
+	for _, c := range n.node.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			if c.Status == v1.ConditionTrue {
+				return time.Time{}, false
+			}
+
+			return c.LastTransitionTime.Time, true
+		}
+	}
+
+	// a node without Ready condition has not been registered by the kubelet yet
+	return n.node.CreationTimestamp.Time, true
+}
+
+// Cordoned marks the node as schedulable. The node is labeled
+// as cordoned by suss, so we know if we may uncordon it.
 func (n *Node) Cordoned(ctx xhdl.Context, value bool) {
 	valuestr := "false"
+	labelstr := "null"
 	if value {
 		valuestr = "true"
+		labelstr = `"true"`
 	}
-	patch := fmt.Sprintf(`{"spec":{"unschedulable":%s}}`, valuestr)
+	patch := fmt.Sprintf(`{"metadata":{"labels":{"%s":%s}},"spec":{"unschedulable":%s}}`, labelCordoned, labelstr, valuestr)
 
 	nobj := n.node
 	nn, err := n.srv.K8s.CoreV1().Nodes().Patch(ctx, nobj.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
@@ -210,3 +240,56 @@ func (n *Node) Cordoned(ctx xhdl.Context, value bool) {
 
 	n.node = nn
 }
+
+// HasTaint returns true if the node has a taint with the key
+func (n Node) HasTaint(key string) bool {
+	for _, t := range n.node.Spec.Taints {
+		if t.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CordonedBySuss returns true if the node has been cordoned by suss
+func (n Node) CordonedBySuss() bool {
+	return n.node.Spec.Unschedulable && n.node.Labels[labelCordoned] == "true"
+}
+
+// apiEmitEvent creates an Event for the node. If name is set, the Event is
+// only created once with this name, otherwise a name is generated.
+func (srv service) apiEmitEvent(ctx xhdl.Context, node *v1.Node, name, eventType, reason, message string) {
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: srv.LeaseNamespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Node",
+			Name:       node.Name,
+			UID:        node.UID,
+		},
+		Type:                eventType,
+		Reason:              reason,
+		Message:             message,
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		Source:              v1.EventSource{Component: "suss", Host: srv.NodeName},
+		ReportingController: "suss",
+		ReportingInstance:   srv.NodeName,
+	}
+
+	if name == "" {
+		event.GenerateName = node.Name + "."
+	}
+
+	_, err := srv.K8s.CoreV1().Events(srv.LeaseNamespace).Create(ctx, event, metav1.CreateOptions{})
+	if name != "" && errors.IsAlreadyExists(err) {
+		return
+	}
+	ctx.Throw(err)
+}
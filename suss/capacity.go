@@ -0,0 +1,192 @@
+package suss
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gprossliner/xhdl"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// CapacityCheckOff evicts the critical pods without checking the capacity
+	CapacityCheckOff = "off"
+
+	// CapacityCheckWarn warns if the critical pods may not fit on the other nodes
+	CapacityCheckWarn = "warn"
+
+	// CapacityCheckRefuse fails Teardown if the critical pods may not fit on the other nodes
+	CapacityCheckRefuse = "refuse"
+)
+
+// ErrInsufficientCapacity is returned by Teardown with CapacityCheckRefuse, if the
+// critical pods of the node may not fit on the other nodes
+var ErrInsufficientCapacity = errors.New("insufficient capacity for the critical pods")
+
+// resources are the requests of a pod, or the free capacity of a node
+type resources struct {
+	milliCPU int64
+	memory   int64
+	pods     int64
+}
+
+func (r resources) String() string {
+	return fmt.Sprintf("cpu %dm, memory %d", r.milliCPU, r.memory)
+}
+
+func (r resources) add(o resources) resources {
+	return resources{r.milliCPU + o.milliCPU, r.memory + o.memory, r.pods + o.pods}
+}
+
+func (r resources) sub(o resources) resources {
+	return resources{r.milliCPU - o.milliCPU, r.memory - o.memory, r.pods - o.pods}
+}
+
+// fits returns true if the requests o fit into r
+func (r resources) fits(o resources) bool {
+	return o.milliCPU <= r.milliCPU && o.memory <= r.memory && o.pods <= r.pods
+}
+
+// podRequests returns the requests of the pod, which are the ones of the
+// containers, or of the largest init container if more, and the overhead
+func podRequests(pod *v1.Pod) resources {
+	requests := func(l v1.ResourceList) resources {
+		return resources{l.Cpu().MilliValue(), l.Memory().Value(), 0}
+	}
+
+	var r resources
+	for _, c := range pod.Spec.Containers {
+		r = r.add(requests(c.Resources.Requests))
+	}
+
+	for _, c := range pod.Spec.InitContainers {
+		i := requests(c.Resources.Requests)
+		r.milliCPU = max(r.milliCPU, i.milliCPU)
+		r.memory = max(r.memory, i.memory)
+	}
+
+	r = r.add(requests(pod.Spec.Overhead))
+	r.pods = 1
+	return r
+}
+
+// candidate is a node the critical pods may be scheduled on, with its free capacity
+type candidate struct {
+	node *v1.Node
+	free resources
+}
+
+// schedulable returns true if the pod may be scheduled on the node by its
+// node selector and tolerations. Affinities are not considered.
+func (c candidate) schedulable(pod *v1.Pod) bool {
+	if !labels.SelectorFromSet(pod.Spec.NodeSelector).Matches(labels.Set(c.node.Labels)) {
+		return false
+	}
+
+	for _, taint := range c.node.Spec.Taints {
+		if taint.Effect == v1.TaintEffectPreferNoSchedule {
+			continue
+		}
+
+		if !slices.ContainsFunc(pod.Spec.Tolerations, func(t v1.Toleration) bool { return t.ToleratesTaint(&taint) }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// capacityCandidates returns the other nodes, which are Ready and schedulable,
+// with their allocatable capacity minus the requests of their pods. The nodes
+// holding the lock are left out, they are being updated too.
+func (srv service) capacityCandidates(ctx xhdl.Context, ns NodeSet) []*candidate {
+	holders := srv.holderNodes(ctx)
+
+	pods, err := srv.K8s.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: "status.phase!=Succeeded,status.phase!=Failed",
+	})
+	ctx.Throw(err)
+
+	requested := map[string]resources{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName != "" {
+			requested[pod.Spec.NodeName] = requested[pod.Spec.NodeName].add(podRequests(pod))
+		}
+	}
+
+	var candidates []*candidate
+	for _, n := range ns.nodes {
+		if n.Name() == srv.NodeName || n.node.Spec.Unschedulable || slices.Contains(holders, n.Name()) {
+			continue
+		}
+
+		if _, notReady := n.NotReadySince(); notReady {
+			continue
+		}
+
+		a := n.node.Status.Allocatable
+		allocatable := resources{a.Cpu().MilliValue(), a.Memory().Value(), a.Pods().Value()}
+		candidates = append(candidates, &candidate{n.node, allocatable.sub(requested[n.Name()])})
+	}
+
+	return candidates
+}
+
+// unschedulablePods returns the critical pods, which may not fit on the other nodes.
+// The pods are placed on the first node they fit on, the largest pods first.
+func (srv service) unschedulablePods(ctx xhdl.Context, ns NodeSet, criticalPods []v1.Pod) []string {
+	candidates := srv.capacityCandidates(ctx, ns)
+
+	pods := slices.Clone(criticalPods)
+	slices.SortStableFunc(pods, func(a, b v1.Pod) int {
+		ra, rb := podRequests(&a), podRequests(&b)
+		return cmp.Or(cmp.Compare(rb.milliCPU, ra.milliCPU), cmp.Compare(rb.memory, ra.memory))
+	})
+
+	var unschedulable []string
+	for p := range pods {
+		pod := &pods[p]
+		r := podRequests(pod)
+
+		i := slices.IndexFunc(candidates, func(c *candidate) bool {
+			return c.schedulable(pod) && c.free.fits(r)
+		})
+
+		if i < 0 {
+			unschedulable = append(unschedulable, fmt.Sprintf("%s/%s (%v)", pod.Namespace, pod.Name, r))
+			continue
+		}
+
+		candidates[i].free = candidates[i].free.sub(r)
+	}
+
+	return unschedulable
+}
+
+// checkCapacity checks if the critical pods of the node fit on the other nodes,
+// before they are evicted, according to the CapacityCheck. It warns, or fails
+// with ErrInsufficientCapacity if they may stay Pending.
+func (srv service) checkCapacity(ctx xhdl.Context, ns NodeSet, own Node) {
+	if srv.CapacityCheck == CapacityCheckOff {
+		return
+	}
+
+	unschedulable := srv.unschedulablePods(ctx, ns, own.CriticalPods(ctx))
+	if len(unschedulable) == 0 {
+		infof(ctx, "capacity for the critical pods available")
+		return
+	}
+
+	pending := strings.Join(unschedulable, ", ")
+	if srv.CapacityCheck == CapacityCheckRefuse {
+		ctx.Throw(fmt.Errorf("%w, may stay Pending: %s", ErrInsufficientCapacity, pending))
+	}
+
+	outputf(ctx, "warning: %v, may stay Pending: %s", ErrInsufficientCapacity, pending)
+}
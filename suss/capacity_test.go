@@ -0,0 +1,162 @@
+package suss
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gprossliner/xhdl"
+	"github.com/stretchr/testify/assert"
+	"github.com/world-direct/kmutex"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func requests(cpu, memory string) v1.ResourceRequirements {
+	return v1.ResourceRequirements{Requests: v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse(cpu),
+		v1.ResourceMemory: resource.MustParse(memory),
+	}}
+}
+
+func testPod(name, node string, containers ...v1.ResourceRequirements) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: node},
+	}
+
+	for _, r := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Resources: r})
+	}
+
+	return pod
+}
+
+// capacityNode returns a Ready node with the allocatable cpu and memory
+func capacityNode(name, cpu, memory string) *v1.Node {
+	n := testNode(name)
+	n.Status.Allocatable = v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse(cpu),
+		v1.ResourceMemory: resource.MustParse(memory),
+		v1.ResourcePods:   resource.MustParse("110"),
+	}
+
+	return n
+}
+
+func TestPodRequests(t *testing.T) {
+
+	pod := testPod("pod", "", requests("100m", "100Mi"), requests("200m", "50Mi"))
+	assert.Equal(t, resources{300, 150 << 20, 1}, podRequests(pod))
+
+	// the largest init container counts, if more than the containers
+	pod.Spec.InitContainers = []v1.Container{
+		{Resources: requests("500m", "10Mi")},
+		{Resources: requests("100m", "20Mi")},
+	}
+	assert.Equal(t, resources{500, 150 << 20, 1}, podRequests(pod))
+
+	pod.Spec.Overhead = v1.ResourceList{v1.ResourceCPU: resource.MustParse("10m")}
+	assert.Equal(t, resources{510, 150 << 20, 1}, podRequests(pod))
+
+	// a pod without requests still takes a pod slot
+	assert.Equal(t, resources{0, 0, 1}, podRequests(testPod("empty", "", v1.ResourceRequirements{})))
+}
+
+func TestUnschedulablePods(t *testing.T) {
+
+	tainted := capacityNode("tainted", "4", "4Gi")
+	tainted.Spec.Taints = []v1.Taint{{Key: "dedicated", Value: "db", Effect: v1.TaintEffectNoSchedule}}
+
+	labeled := capacityNode("labeled", "1", "1Gi")
+	labeled.Labels = map[string]string{"disk": "ssd"}
+
+	cordoned := capacityNode("cordoned", "4", "4Gi")
+	cordoned.Spec.Unschedulable = true
+
+	notReady := capacityNode("notready", "4", "4Gi")
+	notReady.Status.Conditions[0].Status = v1.ConditionFalse
+
+	tolerating := func(pod *v1.Pod) *v1.Pod {
+		pod.Spec.Tolerations = []v1.Toleration{{Key: "dedicated", Operator: v1.TolerationOpEqual, Value: "db", Effect: v1.TaintEffectNoSchedule}}
+		return pod
+	}
+
+	selecting := func(pod *v1.Pod) *v1.Pod {
+		pod.Spec.NodeSelector = map[string]string{"disk": "ssd"}
+		return pod
+	}
+
+	tests := map[string]struct {
+		nodes         []runtime.Object
+		critical      []*v1.Pod
+		unschedulable []string
+	}{
+		"fits": {
+			[]runtime.Object{capacityNode("other", "1", "1Gi")},
+			[]*v1.Pod{testPod("a", "own", requests("500m", "512Mi")), testPod("b", "own", requests("500m", "512Mi"))},
+			nil,
+		},
+		"too large": {
+			[]runtime.Object{capacityNode("other", "1", "1Gi")},
+			[]*v1.Pod{testPod("a", "own", requests("500m", "512Mi")), testPod("b", "own", requests("600m", "512Mi"))},
+			[]string{"default/a (cpu 500m, memory 536870912)"},
+		},
+		"requests of the running pods": {
+			[]runtime.Object{capacityNode("other", "1", "1Gi"), testPod("running", "other", requests("800m", "100Mi"))},
+			[]*v1.Pod{testPod("a", "own", requests("500m", "512Mi"))},
+			[]string{"default/a (cpu 500m, memory 536870912)"},
+		},
+		"taint not tolerated": {
+			[]runtime.Object{tainted},
+			[]*v1.Pod{testPod("a", "own", requests("500m", "512Mi"))},
+			[]string{"default/a (cpu 500m, memory 536870912)"},
+		},
+		"taint tolerated": {
+			[]runtime.Object{tainted},
+			[]*v1.Pod{tolerating(testPod("a", "own", requests("500m", "512Mi")))},
+			nil,
+		},
+		"node selector": {
+			[]runtime.Object{labeled, capacityNode("other", "4", "4Gi")},
+			[]*v1.Pod{selecting(testPod("a", "own", requests("500m", "512Mi"))), selecting(testPod("b", "own", requests("600m", "512Mi")))},
+			[]string{"default/a (cpu 500m, memory 536870912)"},
+		},
+		"cordoned and NotReady nodes": {
+			[]runtime.Object{cordoned, notReady},
+			[]*v1.Pod{testPod("a", "own", requests("500m", "512Mi"))},
+			[]string{"default/a (cpu 500m, memory 536870912)"},
+		},
+		"node holding the lock": {
+			[]runtime.Object{capacityNode("holder", "4", "4Gi")},
+			[]*v1.Pod{testPod("a", "own", requests("500m", "512Mi"))},
+			[]string{"default/a (cpu 500m, memory 536870912)"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			k8s := fake.NewSimpleClientset(append(tc.nodes, capacityNode("own", "4", "4Gi"))...)
+			clk := clocktesting.NewFakeClock(time.Now())
+			backend := kmutex.NewMemoryBackend()
+			srv := newTestService(k8s, backend, clk, "own", SussOptions{MaxHolders: 2})
+
+			var critical []v1.Pod
+			for _, pod := range tc.critical {
+				critical = append(critical, *pod)
+			}
+
+			err := xhdl.RunContext(context.Background(), func(ctx xhdl.Context) {
+				holder := newTestService(k8s, backend, clk, "holder", SussOptions{MaxHolders: 2})
+				holder.km.TryAcquire(ctx, kmutex.HolderInfo{})
+
+				assert.Equal(t, tc.unschedulable, srv.unschedulablePods(ctx, srv.getNodeSet(ctx), critical))
+			})
+			assert.NoError(t, err)
+		})
+	}
+}
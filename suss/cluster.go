@@ -0,0 +1,117 @@
+package suss
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gprossliner/xhdl"
+	"github.com/world-direct/kmutex"
+)
+
+// clusterIdentityPrefix is the prefix of the holder identity of cluster operations
+const clusterIdentityPrefix = "cluster:"
+
+// clusterLocks are the locks of the cluster operations, by operation
+type clusterLocks struct {
+	mu    sync.Mutex
+	locks map[string]kmutex.Locker
+}
+
+// isClusterIdentity returns true if the holder identity is a cluster operation
+func isClusterIdentity(identity string) bool {
+	return strings.HasPrefix(identity, clusterIdentityPrefix)
+}
+
+// clusterLock returns the lock for the cluster operation, which are the same
+// locks as for the nodes of all node groups, but held exclusively by the
+// operation. See ClusterLockBackends.
+func (srv service) clusterLock(ctx xhdl.Context, operation string) kmutex.Locker {
+	if operation == "" {
+		ctx.Throw(fmt.Errorf("operation required"))
+	}
+
+	if strings.ContainsAny(operation, ",/@") {
+		ctx.Throw(fmt.Errorf("invalid operation %q", operation))
+	}
+
+	srv.cluster.mu.Lock()
+	defer srv.cluster.mu.Unlock()
+
+	if l, found := srv.cluster.locks[operation]; found {
+		return l
+	}
+
+	backends := srv.ClusterLockBackends
+	if len(backends) == 0 {
+		backends = []kmutex.Backend{srv.LockBackend}
+	}
+
+	// without SessionTimeout, as there is no command to refresh the session
+	// of a cluster operation. It holds the lock until /cluster/release.
+	var locks []*kmutex.Kmutex
+	for _, backend := range backends {
+		locks = append(locks, &kmutex.Kmutex{
+			LeaseName:      srv.LockName,
+			LeaseNamespace: srv.LeaseNamespace,
+			HolderIdentity: holderIdentity(clusterIdentityPrefix+operation, "", srv.ClusterName),
+			Clientset:      srv.K8s,
+			RetryInterval:  time.Second,
+			LeaseDuration:  srv.LeaseDuration,
+			Backend:        backend,
+			Exclusive:      true,
+			Observer:       srv.LockObserver,
+			Clock:          srv.Clock,
+		})
+	}
+
+	var l kmutex.Locker = locks[0]
+	if len(locks) > 1 {
+		l = kmutex.NewGroup(locks...)
+	}
+
+	srv.cluster.locks[operation] = l
+	return l
+}
+
+// SynchronizeCluster acquires the lock exclusively for a cluster wide operation,
+// like an etcd defrag. It waits until no node holds the lock, and while it is
+// held no node passes Synchronize.
+func (srv service) SynchronizeCluster(ctx xhdl.Context, operation, reason, client string) {
+	km := srv.clusterLock(ctx, operation)
+
+	info := kmutex.HolderInfo{
+		Version: srv.Version,
+		Session: newSessionID(),
+		Reason:  reason,
+		Client:  client,
+	}
+
+	lastPosition := -1
+	token := km.Acquire(ctx, info, func(ctx xhdl.Context, status kmutex.WaitStatus) {
+		infof(ctx, "could not aquire Lease for %s, currently owned by %s", operation, strings.Join(status.Owners, ", "))
+
+		if status.Position != lastPosition {
+			outputf(ctx, "waiting for lock at position %d of %d", status.Position, status.Waiting)
+			lastPosition = status.Position
+		}
+	})
+
+	infof(ctx, "lease successfully aquired for cluster operation %s", operation)
+	outputf(ctx, "token=%d", token)
+	outputf(ctx, "session=%s", info.Session)
+}
+
+// ReleaseCluster releases the lock of the cluster operation. Without session
+// all sessions of the operation are released.
+func (srv service) ReleaseCluster(ctx xhdl.Context, operation, session string) {
+	km := srv.clusterLock(ctx, operation)
+
+	if km.ReleaseSession(ctx, session) {
+		infof(ctx, "session %s of cluster operation %s released, lock still held by other sessions", session, operation)
+		return
+	}
+
+	infof(ctx, "lock of cluster operation %s released", operation)
+}
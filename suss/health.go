@@ -0,0 +1,41 @@
+package suss
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/gprossliner/xhdl"
+	v1 "k8s.io/api/core/v1"
+)
+
+// clusterHealthProblems returns why the other nodes block an update, empty if the
+// cluster is healthy or the ClusterHealthCheck is disabled. The nodes holding the
+// lock are skipped, they may be down while they are updated.
+func (srv service) clusterHealthProblems(ctx xhdl.Context) []string {
+	if !srv.ClusterHealthCheck {
+		return nil
+	}
+
+	holders := srv.holderNodes(ctx)
+
+	var problems []string
+	for _, n := range srv.getNodeSet(ctx).nodes {
+		if n.Name() == srv.NodeName || slices.Contains(holders, n.Name()) {
+			continue
+		}
+
+		if _, notReady := n.NotReadySince(); notReady {
+			problems = append(problems, fmt.Sprintf("node %s is NotReady", n.Name()))
+		}
+
+		if n.node.Spec.Unschedulable && !n.CordonedBySuss() {
+			problems = append(problems, fmt.Sprintf("node %s is cordoned", n.Name()))
+		}
+
+		if n.HasTaint(v1.TaintNodeUnreachable) {
+			problems = append(problems, fmt.Sprintf("node %s is unreachable", n.Name()))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,151 @@
+package suss
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gprossliner/xhdl"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// NodeGroup is a group of nodes with its own lock and concurrency limit
+type NodeGroup struct {
+	// Name of the group, the lock of the group is named "sync-<name>"
+	Name string
+
+	// Selector selects the nodes of the group, a node belongs to the
+	// first group selecting it
+	Selector labels.Selector
+
+	// MaxUnavailable is the number of nodes of the group that may hold the
+	// lock at the same time, absolute or as percentage of the nodes of the group
+	MaxUnavailable intstr.IntOrString
+}
+
+// ParseNodeGroups parses groups separated by ";", each in the form
+// "<name> <maxUnavailable> [<selector>]", e.g. "workers 10% !node-role.kubernetes.io/control-plane".
+// maxUnavailable is a number or a percentage, and the selector is a label selector
+// which selects all nodes if omitted.
+func ParseNodeGroups(s string) ([]NodeGroup, error) {
+	var groups []NodeGroup
+	for _, gs := range strings.Split(s, ";") {
+		if strings.TrimSpace(gs) == "" {
+			continue
+		}
+
+		g, err := parseNodeGroup(gs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node group %q: %w", strings.TrimSpace(gs), err)
+		}
+
+		for _, o := range groups {
+			if o.Name == g.Name {
+				return nil, fmt.Errorf("duplicate node group %q", g.Name)
+			}
+		}
+
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
+
+func parseNodeGroup(s string) (NodeGroup, error) {
+	var g NodeGroup
+
+	// the selector may contain spaces, e.g. "zone in (a, b)"
+	fields := strings.SplitN(strings.TrimSpace(s), " ", 3)
+	if len(fields) < 2 {
+		return g, fmt.Errorf("expected \"<name> <maxUnavailable> [<selector>]\"")
+	}
+
+	g.Name = fields[0]
+	if errs := validation.IsDNS1123Label(g.Name); len(errs) > 0 {
+		return g, fmt.Errorf("invalid name: %s", strings.Join(errs, ", "))
+	}
+
+	g.MaxUnavailable = intstr.Parse(fields[1])
+	if _, err := intstr.GetScaledValueFromIntOrPercent(&g.MaxUnavailable, 100, false); err != nil {
+		return g, err
+	}
+
+	if g.MaxUnavailable.Type == intstr.Int && g.MaxUnavailable.IntVal < 1 {
+		return g, fmt.Errorf("maxUnavailable must be at least 1")
+	}
+
+	g.Selector = labels.Everything()
+	if len(fields) == 3 {
+		var err error
+		if g.Selector, err = labels.Parse(fields[2]); err != nil {
+			return g, err
+		}
+	}
+
+	return g, nil
+}
+
+// String returns the group in the form parsed by ParseNodeGroups
+func (g NodeGroup) String() string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s %s", g.Name, g.MaxUnavailable.String(), g.Selector))
+}
+
+// LockName returns the name of the lock of the group
+func (g NodeGroup) LockName() string {
+	return "sync-" + g.Name
+}
+
+// MaxHolders returns the number of nodes of a group of size that may hold
+// the lock at the same time. A percentage is rounded down, but at least 1.
+func (g NodeGroup) MaxHolders(size int) int {
+	n, err := intstr.GetScaledValueFromIntOrPercent(&g.MaxUnavailable, size, false)
+	if err != nil || n < 1 {
+		return 1
+	}
+
+	return n
+}
+
+// SelectNodeGroup returns the first group selecting the node,
+// and false if it belongs to no group
+func SelectNodeGroup(groups []NodeGroup, node *v1.Node) (NodeGroup, bool) {
+	for _, g := range groups {
+		if g.Selector.Matches(labels.Set(node.Labels)) {
+			return g, true
+		}
+	}
+
+	return NodeGroup{}, false
+}
+
+// nodeGroupMaxHolders returns the number of nodes of our NodeGroup that may hold
+// the lock at the same time. It is computed from the current nodes, so all nodes
+// of the group use the same limit, also if the group has changed since they started.
+func (srv service) nodeGroupMaxHolders(ctx xhdl.Context) int {
+	i := slices.IndexFunc(srv.NodeGroups, func(g NodeGroup) bool { return g.Name == srv.NodeGroup })
+	if i < 0 {
+		ctx.Throw(fmt.Errorf("unknown node group %q", srv.NodeGroup))
+	}
+
+	nodes, err := srv.K8s.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	ctx.Throw(err)
+
+	group := srv.NodeGroups[i]
+	return group.MaxHolders(NodeGroupSize(srv.NodeGroups, group, nodes.Items))
+}
+
+// NodeGroupSize returns the number of nodes belonging to the group
+func NodeGroupSize(groups []NodeGroup, group NodeGroup, nodes []v1.Node) int {
+	size := 0
+	for i := range nodes {
+		if g, ok := SelectNodeGroup(groups, &nodes[i]); ok && g.Name == group.Name {
+			size++
+		}
+	}
+
+	return size
+}
@@ -0,0 +1,177 @@
+package suss
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gprossliner/xhdl"
+	"github.com/stretchr/testify/assert"
+	"github.com/world-direct/kmutex"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// groupNode returns a Ready node with the labels
+func groupNode(name string, nodeLabels map[string]string) *v1.Node {
+	n := testNode(name)
+	n.Labels = nodeLabels
+	return n
+}
+
+func TestParseNodeGroups(t *testing.T) {
+
+	groups, err := ParseNodeGroups("workers 10% !node-role.kubernetes.io/control-plane; storage 1 role in (ceph, nfs);all 2")
+	assert.NoError(t, err)
+
+	assert.Len(t, groups, 3)
+	assert.Equal(t, "workers", groups[0].Name)
+	assert.Equal(t, intstr.FromString("10%"), groups[0].MaxUnavailable)
+	assert.Equal(t, "!node-role.kubernetes.io/control-plane", groups[0].Selector.String())
+	assert.Equal(t, "storage", groups[1].Name)
+	assert.Equal(t, intstr.FromInt32(1), groups[1].MaxUnavailable)
+	assert.Equal(t, "role in (ceph,nfs)", groups[1].Selector.String())
+	assert.Equal(t, labels.Everything(), groups[2].Selector)
+	assert.Equal(t, "sync-storage", groups[1].LockName())
+	assert.Equal(t, "storage 1 role in (ceph,nfs)", groups[1].String())
+
+	groups, err = ParseNodeGroups(" ; ")
+	assert.NoError(t, err)
+	assert.Empty(t, groups)
+
+	invalid := map[string]string{
+		"no limit":       "workers",
+		"name":           "Workers 1",
+		"limit":          "workers ten",
+		"percentage":     "workers 10.5%",
+		"zero":           "workers 0",
+		"selector":       "workers 1 role in (",
+		"duplicate name": "workers 1; workers 2",
+	}
+
+	for name, s := range invalid {
+		t.Run("invalid "+name, func(t *testing.T) {
+			_, err := ParseNodeGroups(s)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNodeGroupMaxHolders(t *testing.T) {
+
+	tests := map[string]struct {
+		maxUnavailable string
+		size           int
+		maxHolders     int
+	}{
+		"absolute":                {"3", 10, 3},
+		"absolute above the size": {"3", 2, 3},
+		"percentage":              {"20%", 10, 2},
+		"percentage rounded down": {"25%", 10, 2},
+		"percentage at least 1":   {"10%", 5, 1},
+		"percentage of no nodes":  {"50%", 0, 1},
+		"percentage of all nodes": {"100%", 7, 7},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			groups, err := ParseNodeGroups("group " + tc.maxUnavailable)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.maxHolders, groups[0].MaxHolders(tc.size))
+		})
+	}
+}
+
+func TestSelectNodeGroup(t *testing.T) {
+
+	groups, err := ParseNodeGroups("storage 1 role=storage; workers 10% !node-role.kubernetes.io/control-plane")
+	assert.NoError(t, err)
+
+	tests := map[string]struct {
+		labels map[string]string
+		group  string
+		found  bool
+	}{
+		"first group":           {map[string]string{"role": "storage"}, "storage", true},
+		"first selecting group": {map[string]string{"role": "storage", "zone": "a"}, "storage", true},
+		"second group":          {map[string]string{"role": "web"}, "workers", true},
+		"no labels":             {nil, "workers", true},
+		"no group":              {map[string]string{"node-role.kubernetes.io/control-plane": ""}, "", false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			group, found := SelectNodeGroup(groups, groupNode("node", tc.labels))
+			assert.Equal(t, tc.found, found)
+			assert.Equal(t, tc.group, group.Name)
+		})
+	}
+
+	// a node of both groups only counts for the first one
+	nodes := []v1.Node{
+		*groupNode("storage1", map[string]string{"role": "storage"}),
+		*groupNode("worker1", nil),
+		*groupNode("worker2", map[string]string{"role": "web"}),
+		*groupNode("master1", map[string]string{"node-role.kubernetes.io/control-plane": ""}),
+	}
+	assert.Equal(t, 1, NodeGroupSize(groups, groups[0], nodes))
+	assert.Equal(t, 2, NodeGroupSize(groups, groups[1], nodes))
+}
+
+func TestNodeGroupMaxHoldersFollowsNodes(t *testing.T) {
+
+	k8s := fake.NewSimpleClientset(groupNode("node1", nil), groupNode("node2", nil))
+	clk := clocktesting.NewFakeClock(time.Now())
+	ctx := context.Background()
+
+	groups, err := ParseNodeGroups("workers 50%")
+	assert.NoError(t, err)
+
+	node1 := newTestService(k8s, kmutex.NewMemoryBackend(), clk, "node1", SussOptions{NodeGroups: groups, NodeGroup: "workers"})
+
+	err = xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		assert.Equal(t, 1, node1.nodeGroupMaxHolders(ctx))
+
+		// the limit grows with the group, without a restart
+		for _, name := range []string{"node3", "node4"} {
+			_, err := k8s.CoreV1().Nodes().Create(ctx, groupNode(name, nil), metav1.CreateOptions{})
+			ctx.Throw(err)
+		}
+
+		assert.Equal(t, 2, node1.nodeGroupMaxHolders(ctx))
+	})
+	assert.NoError(t, err)
+}
+
+func TestNodeGroupSharedLockUsesMaxHolders(t *testing.T) {
+
+	k8s := fake.NewSimpleClientset(groupNode("node1", nil), groupNode("node2", nil), groupNode("node3", nil), groupNode("node4", nil))
+	clk := clocktesting.NewFakeClock(time.Now())
+	local, shared := kmutex.NewMemoryBackend(), kmutex.NewMemoryBackend()
+
+	groups, err := ParseNodeGroups("workers 50%")
+	assert.NoError(t, err)
+
+	newService := func(node string) service {
+		return newTestService(k8s, local, clk, node, SussOptions{
+			MaxHolders:          1,
+			NodeGroups:          groups,
+			NodeGroup:           "workers",
+			CoordinationBackend: shared,
+			ClusterName:         "a",
+		})
+	}
+
+	err = xhdl.RunContext(context.Background(), func(ctx xhdl.Context) {
+		// the group allows 2 nodes in this cluster, but MaxHolders 1 in all clusters
+		_, acquired := newService("node1").km.TryAcquire(ctx, kmutex.HolderInfo{})
+		assert.True(t, acquired)
+		_, acquired = newService("node2").km.TryAcquire(ctx, kmutex.HolderInfo{})
+		assert.False(t, acquired)
+	})
+	assert.NoError(t, err)
+}
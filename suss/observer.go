@@ -0,0 +1,29 @@
+package suss
+
+import (
+	"time"
+
+	"github.com/world-direct/kmutex"
+	"k8s.io/klog/v2"
+)
+
+// logObserver logs the transitions of the lock, it is the default LockObserver
+type logObserver struct{}
+
+func (logObserver) AcquireAttempt(lock, identity string) {}
+
+func (logObserver) Acquired(lock, identity string, token kmutex.Token, wait time.Duration) {
+	klog.Infof("%s acquired by %s with token %d after waiting %v", lock, identity, token, wait.Round(time.Second))
+}
+
+func (logObserver) ConflictRetry(lock string, retry int, err error) {
+	klog.V(2).Infof("update of %s conflicted, retry %d: %v", lock, retry, err)
+}
+
+func (logObserver) Released(lock, identity string, token kmutex.Token) {
+	klog.Infof("%s with token %d released by %s", lock, token, identity)
+}
+
+func (logObserver) TakenOver(lock string, previous kmutex.Holder, identity, reason string) {
+	klog.Warningf("%s held by %s since %v taken over by %s: %s", lock, previous.Identity, previous.AcquireTime.Time, identity, reason)
+}
@@ -0,0 +1,161 @@
+package suss
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gprossliner/xhdl"
+	"github.com/world-direct/kmutex"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// OverduePolicyEscalate logs an error and emits a Warning Event for an overdue hold
+	OverduePolicyEscalate = "escalate"
+
+	// OverduePolicyRelease escalates, and force releases an overdue hold
+	OverduePolicyRelease = "release"
+
+	// overdueEscalationInterval is the interval our own overdue hold is escalated in
+	overdueEscalationInterval = 10 * time.Minute
+)
+
+// Extend extends the hold of our node by duration from now, or by the
+// MaxHoldDuration if 0. The reason is required, and recorded on the lock
+// and as an Event for the node.
+func (srv service) Extend(ctx xhdl.Context, token kmutex.Token, session string, duration time.Duration, reason string) {
+	if reason == "" {
+		ctx.Throw(fmt.Errorf("reason required to extend"))
+	}
+
+	if duration <= 0 {
+		duration = srv.MaxHoldDuration
+	}
+
+	if duration <= 0 {
+		ctx.Throw(fmt.Errorf("duration required to extend, no max hold duration configured"))
+	}
+
+	srv.checkToken(ctx, token)
+	srv.checkSession(ctx, session)
+
+	deadline := srv.km.Extend(ctx, duration, reason)
+	outputf(ctx, "deadline=%s", deadline.UTC().Format(time.RFC3339))
+
+	own := srv.getNodeSet(ctx).OwnNode()
+	message := fmt.Sprintf("lock extended until %s: %s", deadline.UTC().Format(time.RFC3339), reason)
+	srv.apiEmitEvent(ctx, own.node, "", v1.EventTypeNormal, "LockExtended", message)
+}
+
+// checkOverdueHolders acts on the holds of owners that are overdue, according
+// to the OverduePolicy. Cluster operations have no deadline, and the holds of
+// other clusters are handled by their cluster.
+func (srv service) checkOverdueHolders(ctx xhdl.Context, owners []string) {
+	now := srv.Clock.Now()
+
+	var ns *NodeSet
+	for _, h := range srv.km.Describe(ctx).Holders {
+		if !slices.Contains(owners, h.Identity) || !srv.isLocalHolder(h.Identity) || !h.Overdue(now) {
+			continue
+		}
+
+		if ns == nil {
+			s := srv.getNodeSet(ctx)
+			ns = &s
+		}
+
+		srv.handleOverdue(ctx, *ns, h, now)
+	}
+}
+
+// handleOverdue escalates the overdue hold, and releases it if the policy says so
+func (srv service) handleOverdue(ctx xhdl.Context, ns NodeSet, h kmutex.Holder, now time.Time) {
+	message := srv.escalateOverdue(ctx, ns, h, now)
+
+	if srv.OverduePolicy == OverduePolicyRelease {
+		srv.ForceRelease(ctx, h.Identity, message)
+	}
+}
+
+// escalateOverdue logs an error and emits a Warning Event for the overdue hold,
+// and returns the message
+func (srv service) escalateOverdue(ctx xhdl.Context, ns NodeSet, h kmutex.Holder, now time.Time) string {
+	overdue := now.Sub(h.Deadline.Time).Round(time.Second)
+	message := fmt.Sprintf("lock held since %s is overdue for %v", h.AcquireTime.UTC().Format(time.RFC3339), overdue)
+	klog.FromContext(ctx).Error(fmt.Errorf("%s", message), "lock hold overdue", "holder", h.Identity, "token", h.Token)
+
+	// the event is emitted once for the hold
+	name, _ := holderNode(h.Identity)
+	if node, found := ns.FindNode(name); found {
+		eventName := fmt.Sprintf("%s.overdue.%d", name, h.Token)
+		srv.apiEmitEvent(ctx, node.node, eventName, v1.EventTypeWarning, "LockHoldOverdue", message)
+	}
+
+	return message
+}
+
+// deadlineWatch is the watch of the deadline of our own hold, by its token
+type deadlineWatch struct {
+	mu    sync.Mutex
+	token kmutex.Token
+}
+
+// watchOwnDeadline escalates our own hold of token when it is overdue, so that
+// it is noticed also if no node is waiting for the lock. It waits in the
+// background for the deadline, following its extensions, until the hold
+// is released. Our own hold is never released by the OverduePolicy.
+func (srv service) watchOwnDeadline(ctx context.Context, token kmutex.Token) {
+	srv.deadline.mu.Lock()
+	defer srv.deadline.mu.Unlock()
+
+	if srv.deadline.token == token {
+		return
+	}
+
+	srv.deadline.token = token
+	go srv.waitForOwnDeadline(context.WithoutCancel(ctx), token)
+}
+
+// waitForOwnDeadline is the loop of watchOwnDeadline
+func (srv service) waitForOwnDeadline(ctx context.Context, token kmutex.Token) {
+	defer func() {
+		srv.deadline.mu.Lock()
+		if srv.deadline.token == token {
+			srv.deadline.token = 0
+		}
+		srv.deadline.mu.Unlock()
+	}()
+
+	for {
+		var wait time.Duration
+		err := xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+			h, held := srv.ownHolder(ctx)
+			if !held || h.Token != token || h.Deadline == nil {
+				return
+			}
+
+			now := srv.Clock.Now()
+			if !h.Overdue(now) {
+				wait = h.Deadline.Sub(now) + time.Second
+				return
+			}
+
+			srv.escalateOverdue(ctx, srv.getNodeSet(ctx), h, now)
+			wait = overdueEscalationInterval
+		})
+
+		if err != nil {
+			klog.FromContext(ctx).Error(err, "failed to check the deadline of our hold", "token", token)
+			wait = overdueEscalationInterval
+		} else if wait == 0 {
+			return
+		}
+
+		t := srv.Clock.NewTimer(wait)
+		<-t.C()
+	}
+}
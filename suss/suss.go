@@ -2,7 +2,12 @@ package suss
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"slices"
 	"strings"
 	"time"
 
@@ -10,8 +15,12 @@ import (
 	"github.com/world-direct/kmutex"
 	"github.com/world-direct/looper"
 
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 )
 
 type SussOptions struct {
@@ -20,20 +29,125 @@ type SussOptions struct {
 	ConsiderStatefulSetCritical  bool
 	ConsiderSoleReplicasCritical bool
 	K8s                          kubernetes.Interface
+
+	// LeaseDuration is the time after which the lock of a node that
+	// failed to renew it is considered free, 0 to never expire
+	LeaseDuration time.Duration
+
+	// SessionTimeout is the time after which a session not refreshed by
+	// Refresh or the other commands taking it expires, and with the last
+	// session the lock of the node is released. 0 to never expire.
+	SessionTimeout time.Duration
+
+	// MaxHolders is the number of nodes that may hold the lock at the same time
+	MaxHolders int
+
+	// LockName is the name of the lock, e.g. of the node group, defaults to "sync"
+	LockName string
+
+	// NodeGroups are the groups of nodes with their own lock and limit
+	NodeGroups []NodeGroup
+
+	// NodeGroup is the name of the NodeGroups our node belongs to. Its
+	// MaxUnavailable replaces MaxHolders, and is computed from the current
+	// nodes of the group every time the lock is acquired. It doesn't apply
+	// to the lock shared with other clusters.
+	NodeGroup string
+
+	// LockBackend stores the lock, defaults to the Lease named LockName in LeaseNamespace
+	LockBackend kmutex.Backend
+
+	// ClusterLockBackends store the locks taken exclusively by cluster operations,
+	// e.g. the locks of all node groups. Defaults to the LockBackend.
+	ClusterLockBackends []kmutex.Backend
+
+	// Version is the version of suss, recorded on the lock
+	Version string
+
+	// StaleHolderThreshold is the time after which the lock of a holder
+	// node that is NotReady is taken over by a waiting node, 0 to never
+	// take it over. The lock of a deleted node is always taken over.
+	StaleHolderThreshold time.Duration
+
+	// MaxHoldDuration is the time a node may hold the lock, unless extended
+	// by Extend. If a hold is overdue, the nodes waiting for the lock act on
+	// it according to the OverduePolicy. 0 for no limit.
+	MaxHoldDuration time.Duration
+
+	// OverduePolicy is OverduePolicyEscalate or OverduePolicyRelease,
+	// defaults to OverduePolicyEscalate
+	OverduePolicy string
+
+	// LockObserver gets notified about the transitions of the lock, e.g. for
+	// metrics. Defaults to logging them.
+	LockObserver kmutex.Observer
+
+	// Clock is used for all timing of suss and the lock, defaults to the real clock
+	Clock clock.WithTicker
+
+	// NodeUID is the UID of the Node object of NodeName. It is part of the
+	// identity of the lock holder, so that a node recreated with the same name
+	// doesn't inherit the lock of its previous incarnation.
+	NodeUID types.UID
+
+	// CoordinationBackend stores a lock shared with other clusters, e.g. in a
+	// coordination cluster, which is acquired in addition to the lock of this
+	// cluster. To use the shared lock instead, set it as LockBackend.
+	CoordinationBackend kmutex.Backend
+
+	// ClusterName is the name of this cluster, which is part of the identity
+	// of the lock holder. Required if the lock is shared with other clusters.
+	ClusterName string
+
+	// MaintenanceWindows are the times in which nodes may be updated. The lock
+	// is only granted if the update ends within a window. No restriction if empty.
+	MaintenanceWindows []MaintenanceWindow
+
+	// WindowPolicy is WindowPolicyWait or WindowPolicyRefuse, what Synchronize
+	// does outside of a maintenance window. Defaults to WindowPolicyWait.
+	WindowPolicy string
+
+	// UpdateDuration is the expected time of an update, used to check if it ends
+	// within the maintenance window. Defaults to the MaxHoldDuration.
+	UpdateDuration time.Duration
+
+	// ClusterHealthCheck lets Synchronize wait until all other nodes are Ready,
+	// reachable and not cordoned by others than suss. The nodes holding the
+	// lock are expected to be down while they are updated.
+	ClusterHealthCheck bool
+
+	// TopologyDomain is the topology domain of the node, e.g. its zone or rack.
+	// If set, at most one node per domain holds the lock at the same time, and
+	// the nodes of separate domains are updated concurrently up to MaxHolders.
+	TopologyDomain string
+
+	// CapacityCheck is CapacityCheckOff, CapacityCheckWarn or CapacityCheckRefuse,
+	// what Teardown does if the critical pods may not fit on the other nodes.
+	// Defaults to CapacityCheckOff.
+	CapacityCheck string
 }
 
 type service struct {
-	km kmutex.Kmutex
+	km       kmutex.Locker
+	identity string
+	cluster  *clusterLocks
+	deadline *deadlineWatch
 	SussOptions
 }
 
 type Service interface {
 	Start(ctx xhdl.Context)
-	Synchronize(ctx xhdl.Context)
-	Teardown(ctx xhdl.Context)
-	Release(ctx xhdl.Context)
-	ReleaseDelayed(ctx xhdl.Context)
+	Synchronize(ctx xhdl.Context, reason, client, session string)
+	SynchronizeCluster(ctx xhdl.Context, operation, reason, client string)
+	ReleaseCluster(ctx xhdl.Context, operation, session string)
+	Teardown(ctx xhdl.Context, token kmutex.Token, session string)
+	Release(ctx xhdl.Context, token kmutex.Token, session string)
+	ReleaseDelayed(ctx xhdl.Context, token kmutex.Token, session string)
+	ForceRelease(ctx xhdl.Context, node, reason string)
+	Extend(ctx xhdl.Context, token kmutex.Token, session string, duration time.Duration, reason string)
+	Refresh(ctx xhdl.Context, token kmutex.Token, session string)
 	GetCriticalPods(ctx xhdl.Context) []string
+	LockStatus(ctx xhdl.Context) kmutex.Description
 	TestFail(ctx xhdl.Context)
 }
 
@@ -43,37 +157,212 @@ const (
 	labelLastRelease    = labelPrefix + "lastrelease"
 	labelCriticalPod    = labelPrefix + "critical"
 	labelPodEvicted     = labelPrefix + "evicted"
+	labelCordoned       = labelPrefix + "cordoned"
 )
 
 func NewService(options SussOptions) Service {
 
+	if options.LockObserver == nil {
+		options.LockObserver = logObserver{}
+	}
+
+	if options.Clock == nil {
+		options.Clock = clock.RealClock{}
+	}
+
+	if options.LockName == "" {
+		options.LockName = "sync"
+	}
+
+	if options.WindowPolicy == "" {
+		options.WindowPolicy = WindowPolicyWait
+	}
+
+	if options.CapacityCheck == "" {
+		options.CapacityCheck = CapacityCheckOff
+	}
+
 	// init struct
+	identity := holderIdentity(options.NodeName, options.NodeUID, options.ClusterName)
 	srv := service{
 		SussOptions: options,
-		km: kmutex.Kmutex{
-			LeaseName:      "sync", // if we may have multiple groups in the future we can use different names
-			LeaseNamespace: options.LeaseNamespace,
-			HolderIdentity: options.NodeName,
-			Clientset:      options.K8s,
-			RetryInterval:  time.Second,
-		},
+		identity:    identity,
+		cluster:     &clusterLocks{locks: map[string]kmutex.Locker{}},
+		deadline:    &deadlineWatch{},
 	}
 
+	var maxHolders func(ctx xhdl.Context) int
+	if options.NodeGroup != "" {
+		maxHolders = srv.nodeGroupMaxHolders
+	}
+
+	km := &kmutex.Kmutex{
+		LeaseName:       options.LockName,
+		LeaseNamespace:  options.LeaseNamespace,
+		HolderIdentity:  identity,
+		Clientset:       options.K8s,
+		RetryInterval:   time.Second,
+		LeaseDuration:   options.LeaseDuration,
+		MaxHolders:      options.MaxHolders,
+		MaxHoldersFunc:  maxHolders,
+		Backend:         options.LockBackend,
+		MaxHoldDuration: options.MaxHoldDuration,
+		SessionTimeout:  options.SessionTimeout,
+		Domain:          options.TopologyDomain,
+		Observer:        options.LockObserver,
+		Clock:           options.Clock,
+	}
+	srv.km = km
+
+	// the lock of this cluster is the primary lock, so the token and
+	// the owners are the ones of this cluster. The lock shared with other
+	// clusters is limited by MaxHolders, as the size of our NodeGroup would
+	// be another one in each cluster.
+	if options.CoordinationBackend != nil {
+		coordination := &kmutex.Kmutex{
+			HolderIdentity:  identity,
+			RetryInterval:   time.Second,
+			LeaseDuration:   options.LeaseDuration,
+			MaxHolders:      options.MaxHolders,
+			Backend:         options.CoordinationBackend,
+			MaxHoldDuration: options.MaxHoldDuration,
+			SessionTimeout:  options.SessionTimeout,
+			Observer:        options.LockObserver,
+			Clock:           options.Clock,
+		}
+		srv.km = kmutex.NewGroup(km, coordination)
+	}
+
+	// srv is complete now, readyToHold uses its lock
+	km.Ready = srv.readyToHold
+
 	return srv
 }
 
+// holderIdentity returns the identity of the node holding the lock,
+// which is "<name>/<uid>@<cluster>". The uid and the cluster are
+// omitted if not known.
+func holderIdentity(name string, uid types.UID, cluster string) string {
+	identity := name
+	if uid != "" {
+		identity += "/" + string(uid)
+	}
+
+	if cluster != "" {
+		identity += "@" + cluster
+	}
+
+	return identity
+}
+
+// holderNode returns the node name and uid of a holder identity,
+// the uid is empty if not part of the identity
+func holderNode(identity string) (string, types.UID) {
+	identity, _, _ = strings.Cut(identity, "@")
+	name, uid, _ := strings.Cut(identity, "/")
+	return name, types.UID(uid)
+}
+
+// holderCluster returns the cluster of a holder identity,
+// empty if not part of the identity
+func holderCluster(identity string) string {
+	_, cluster, _ := strings.Cut(identity, "@")
+	return cluster
+}
+
+// isLocalHolder returns true if the holder identity is a node of this cluster.
+// A holder without cluster is of this cluster, the lock is only shared if
+// all clusters have a name.
+func (srv service) isLocalHolder(identity string) bool {
+	if isClusterIdentity(identity) {
+		return false
+	}
+
+	cluster := holderCluster(identity)
+	return cluster == "" || cluster == srv.ClusterName
+}
+
+// holderNodes returns the names of the nodes of this cluster holding the lock
+func (srv service) holderNodes(ctx xhdl.Context) []string {
+	var names []string
+	for _, owner := range srv.km.CurrentOwners(ctx) {
+		if srv.isLocalHolder(owner) {
+			name, _ := holderNode(owner)
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
 func (srv service) Start(ctx xhdl.Context) {
 
 	// get our node to test the connection and validate the argument
 	own := srv.getNodeSet(ctx).OwnNode()
 	infof(ctx, "node %s found\n", own.Name())
 
+	// a lock held by our node before it has been recreated is not ours
+	srv.recoverPreviousIncarnation(ctx)
+
 	// check for delayed release
 	if own.GetLabel(ctx, labelDelayedRelease) == "true" {
 		infof(ctx, "node marked for delayed release, releasing lock now")
-		srv.Release(ctx)
+		srv.release(ctx, 0, "", true)
 
 		own.SetLabel(ctx, labelDelayedRelease, "")
+		return
+	}
+
+	// if we hold the lock from before a restart, we need to renew it
+	if srv.holdsLock(ctx) {
+		infof(ctx, "lock held by us, resume renewal")
+		token, _ := srv.km.TryAcquire(ctx, kmutex.HolderInfo{Version: srv.Version})
+		srv.watchOwnDeadline(ctx, token)
+	}
+}
+
+// holdsLock returns true if our node is one of the holders of the lock
+func (srv service) holdsLock(ctx xhdl.Context) bool {
+	return slices.Contains(srv.km.CurrentOwners(ctx), srv.identity)
+}
+
+// recoverPreviousIncarnation recovers a lock held with our node name, but
+// another identity. A hold of our uid without cluster name, acquired before
+// the ClusterName has been set, and a hold without uid acquired after our Node
+// has been created, or without acquire time, e.g. by a version of suss not
+// using uids, are ours. They are taken over with their token, so an update in
+// progress keeps the lock.
+// A hold of another uid or older than our Node has been acquired by a previous
+// incarnation of our node, which is gone and will never release it, so it is
+// force released.
+func (srv service) recoverPreviousIncarnation(ctx xhdl.Context) {
+	owners := srv.km.CurrentOwners(ctx)
+
+	var created time.Time
+	for _, h := range srv.km.Describe(ctx).Holders {
+		name, uid := holderNode(h.Identity)
+		if name != srv.NodeName || h.Identity == srv.identity || !srv.isLocalHolder(h.Identity) || !slices.Contains(owners, h.Identity) {
+			continue
+		}
+
+		if created.IsZero() {
+			created = srv.getNodeSet(ctx).OwnNode().node.CreationTimestamp.Time
+		}
+
+		var reason string
+		switch {
+		case uid == srv.NodeUID:
+			reason = "held without cluster name before the lock has been shared"
+		case uid == "" && (h.AcquireTime.IsZero() || !h.AcquireTime.Time.Before(created)):
+			reason = "held without node uid by a previous version of suss"
+		default:
+			infof(ctx, "lock held by a previous incarnation %s of our node, releasing it", h.Identity)
+			srv.ForceRelease(ctx, h.Identity, "node has been recreated")
+			continue
+		}
+
+		infof(ctx, "lock held by our node as %s, taking it over", h.Identity)
+		srv.km.TakeOver(ctx, h.Identity, reason)
 	}
 }
 
@@ -82,36 +371,301 @@ func infof(ctx context.Context, format string, args ...interface{}) {
 	klog.FromContext(ctx).Info(fmt.Sprintf(format, args...))
 }
 
-func (srv service) Synchronize(ctx xhdl.Context) {
-	looper.Loop(ctx, time.Second*10, func(ctx xhdl.Context) (exit bool) {
-		return func() bool {
+type outputKey struct{}
 
-			// this is for information only to notify about existing owner
-			// if is not race-free if owned by another node (this is done in TryAcquire),
-			// but safe it owned by us
-			owner := srv.km.CurrentOwner(ctx)
-			if owner == srv.km.HolderIdentity {
-				infof(ctx, "lock already owned by us %s", owner)
-				return true
-			}
+// WithOutput returns a context with w as the output of the command,
+// which gets the messages written by outputf
+func WithOutput(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, outputKey{}, w)
+}
 
-			if !srv.km.TryAcquire(ctx) {
-				infof(ctx, "could not aquire Lease, currently owned by %s", srv.km.CurrentOwner(ctx))
-				return false
-			} else {
-				infof(ctx, "lease successfully aquired by %s", srv.km.HolderIdentity)
-				return true
-			}
-		}()
+// outputf logs like infof, and writes the message to the output of the command
+func outputf(ctx context.Context, format string, args ...interface{}) {
+	infof(ctx, format, args...)
+
+	if w, ok := ctx.Value(outputKey{}).(io.Writer); ok {
+		fmt.Fprintf(w, format+"\n", args...)
+	}
+}
+
+// checkToken throws if the lock is no longer held with the fencing token.
+// A token of 0 is not checked, for scripts not using fencing tokens.
+func (srv service) checkToken(ctx xhdl.Context, token kmutex.Token) {
+	if token == 0 {
+		return
+	}
+
+	if !srv.km.CheckToken(ctx, token) {
+		ctx.Throw(fmt.Errorf("fencing token %d is no longer valid, the lock has been released or taken over", token))
+	}
+}
+
+// ownHolder returns our hold of the lock, and false if not held
+func (srv service) ownHolder(ctx xhdl.Context) (kmutex.Holder, bool) {
+	for _, h := range srv.km.Describe(ctx).Holders {
+		if h.Identity == srv.identity {
+			return h, true
+		}
+	}
+
+	return kmutex.Holder{}, false
+}
+
+// checkSession throws if the session doesn't hold the lock, and refreshes
+// it so it doesn't expire. An empty session is not checked, for scripts
+// not using sessions.
+func (srv service) checkSession(ctx xhdl.Context, session string) {
+	if session == "" {
+		return
+	}
+
+	err := xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		srv.km.RefreshSession(ctx, session)
+	})
+
+	if errors.Is(err, kmutex.ErrUnknownSession) || errors.Is(err, kmutex.ErrNotHolder) {
+		ctx.Throw(fmt.Errorf("session %s does not hold the lock", session))
+	}
+
+	ctx.Throw(err)
+}
+
+// Refresh refreshes the session, so that it doesn't expire after the
+// SessionTimeout while the update is in progress
+func (srv service) Refresh(ctx xhdl.Context, token kmutex.Token, session string) {
+	if session == "" {
+		ctx.Throw(fmt.Errorf("session required to refresh"))
+	}
+
+	srv.checkToken(ctx, token)
+	srv.checkSession(ctx, session)
+	infof(ctx, "session %s refreshed", session)
+}
+
+// newSessionID returns a random id for the session acquiring the lock
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Synchronize acquires the lock. reason and client are recorded on the lock,
+// to see why and by whom it is held. Every call gets a new session, which
+// holds the lock until it is released, also if the lock is already held by
+// another session of our node. If session is set, this session is resumed
+// instead, so a call retried after a failure doesn't add another session.
+// The lock is only acquired within the MaintenanceWindows, and while the
+// cluster is healthy, if configured.
+func (srv service) Synchronize(ctx xhdl.Context, reason, client, session string) {
+
+	// this is for information only, the lock is acquired
+	// or renewed by Acquire in any case
+	if srv.holdsLock(ctx) {
+		infof(ctx, "lock already owned by us %s", srv.identity)
+	}
+
+	// without this we would wait for ourself
+	srv.recoverPreviousIncarnation(ctx)
+
+	if session == "" {
+		session = newSessionID()
+	}
+
+	// Acquire watches the Lease, so we only get called if something changed
+	info := kmutex.HolderInfo{
+		Version: srv.Version,
+		Session: session,
+		Reason:  reason,
+		Client:  client,
+	}
+
+	lastPosition := -1
+	token := srv.acquire(ctx, info, func(ctx xhdl.Context, status kmutex.WaitStatus) {
+		infof(ctx, "could not aquire Lease, currently owned by %s", strings.Join(status.Owners, ", "))
+
+		if status.Position != lastPosition {
+			outputf(ctx, "waiting for lock at position %d of %d", status.Position, status.Waiting)
+			lastPosition = status.Position
+		}
+
+		// the release of a stale holder wakes Acquire up again
+		srv.recoverStaleHolders(ctx, status.Owners)
+		srv.checkOverdueHolders(ctx, status.Owners)
+	})
+
+	infof(ctx, "lease successfully aquired by %s", srv.NodeName)
+	srv.watchOwnDeadline(ctx, token)
+	outputf(ctx, "token=%d", token)
+	outputf(ctx, "session=%s", info.Session)
+}
+
+// acquire acquires the lock like Acquire, but only within a maintenance window
+// and while the cluster is healthy. Both are checked by readyToHold before the
+// lock is granted, so we keep our place in the queue while the cluster is
+// unhealthy. If the window is missed while waiting for the lock, the queue
+// is left and it waits for the next window.
+func (srv service) acquire(ctx xhdl.Context, info kmutex.HolderInfo, onWait kmutex.WaitFunc) kmutex.Token {
+	for {
+		srv.waitForMaintenanceWindow(ctx)
+
+		var token kmutex.Token
+		lastNotReady := ""
+		err := xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+			token = srv.km.Acquire(ctx, info, func(ctx xhdl.Context, status kmutex.WaitStatus) {
+				if onWait != nil {
+					onWait(ctx, status)
+				}
+
+				srv.checkMaintenanceWindow(ctx)
+
+				if status.NotReady != nil && status.NotReady.Error() != lastNotReady {
+					outputf(ctx, "waiting at the head of the queue: %v", status.NotReady)
+					lastNotReady = status.NotReady.Error()
+				}
+			})
+		})
+
+		if errors.Is(err, errWindowMissed) {
+			infof(ctx, "maintenance window missed while waiting for the lock")
+			srv.km.LeaveQueue(ctx)
+			continue
+		}
+		ctx.Throw(err)
+
+		return token
+	}
+}
+
+// readyToHold returns why the lock may not be granted to us now, nil if it may.
+// It is the Ready of the lock, called right before the lock is granted.
+func (srv service) readyToHold(ctx xhdl.Context) error {
+	if !srv.inMaintenanceWindow() {
+		return errWindowMissed
+	}
+
+	if problems := srv.clusterHealthProblems(ctx); len(problems) > 0 {
+		infof(ctx, "cluster unhealthy: %s", strings.Join(problems, ", "))
+		return fmt.Errorf("cluster unhealthy: %s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// sleep sleeps for d on the Clock, and throws if ctx is done before
+func (srv service) sleep(ctx xhdl.Context, d time.Duration) {
+	t := srv.Clock.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C():
+	case <-ctx.Done():
+		ctx.Throw(ctx.Err())
+	}
+}
+
+// recoverStaleHolders force releases the lock of owners whose node has
+// been deleted, or is NotReady for longer than the StaleHolderThreshold.
+// A node marked for delayed release is expected to be NotReady while it reboots.
+func (srv service) recoverStaleHolders(ctx xhdl.Context, owners []string) {
+	if len(owners) == 0 {
+		return
+	}
+
+	ns := srv.getNodeSet(ctx)
+	for _, owner := range owners {
+		if reason, stale := srv.staleHolder(ctx, ns, owner); stale {
+			infof(ctx, "lock of %s is stale, taking over: %s", owner, reason)
+			srv.ForceRelease(ctx, owner, reason)
+		}
+	}
+}
+
+// staleHolder returns the reason if the lock of the holder node may be taken over
+func (srv service) staleHolder(ctx xhdl.Context, ns NodeSet, owner string) (string, bool) {
+	// cluster operations don't run on the node, and the nodes
+	// of other clusters are recovered by their cluster
+	if !srv.isLocalHolder(owner) {
+		return "", false
+	}
+
+	name, uid := holderNode(owner)
+	node, found := ns.FindNode(name)
+	if !found {
+		return "holder node has been deleted", true
+	}
+
+	if uid != "" && node.node.UID != uid {
+		return "holder node has been recreated", true
+	}
+
+	if srv.StaleHolderThreshold <= 0 || node.GetLabel(ctx, labelDelayedRelease) == "true" {
+		return "", false
+	}
+
+	since, notReady := node.NotReadySince()
+	if !notReady {
+		return "", false
+	}
+
+	if d := srv.Clock.Since(since); d > srv.StaleHolderThreshold {
+		return fmt.Sprintf("holder node NotReady for %v", d.Round(time.Second)), true
+	}
+
+	return "", false
+}
+
+// withLockGuard runs fn with a context that is canceled if the lock is lost
+// in the meantime, which is then reported as an error
+func (srv service) withLockGuard(ctx xhdl.Context, fn func(ctx xhdl.Context)) {
+
+	if !srv.holdsLock(ctx) {
+		ctx.Throw(fmt.Errorf("lock lost: not held by %s", srv.identity))
+	}
+
+	lost := srv.km.Lost()
+	gctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-lost:
+			cancel()
+		case <-gctx.Done():
+		}
+	}()
+
+	err := xhdl.RunContext(gctx, fn)
+
+	select {
+	case <-lost:
+		infof(ctx, "lock lost, aborting")
+		ctx.Throw(fmt.Errorf("lock lost: %w", srv.km.LostReason()))
+	default:
+	}
+
+	ctx.Throw(err)
+}
+
+func (srv service) Teardown(ctx xhdl.Context, token kmutex.Token, session string) {
+	srv.withLockGuard(ctx, func(ctx xhdl.Context) {
+		srv.checkSession(ctx, session)
+		srv.teardown(ctx, token)
 	})
 }
 
-func (srv service) Teardown(ctx xhdl.Context) {
+func (srv service) teardown(ctx xhdl.Context, token kmutex.Token) {
 
 	ns := srv.getNodeSet(ctx)
 	own := ns.OwnNode()
 
+	// the critical pods are evicted to the other nodes
+	srv.checkCapacity(ctx, ns, own)
+
 	// condon
+	srv.checkToken(ctx, token)
 	own.Cordoned(ctx, true)
 	infof(ctx, "node %s cordoned", own.Name())
 
@@ -122,14 +676,15 @@ func (srv service) Teardown(ctx xhdl.Context) {
 		infof(ctx, "evict pod %s/%s", pod.Namespace, pod.Name)
 
 		// label as evicted so we don't evict again
-		srv.apiLabelPod(ctx, &pod, labelPodEvicted, getTSValue())
+		srv.checkToken(ctx, token)
+		srv.apiLabelPod(ctx, &pod, labelPodEvicted, srv.getTSValue())
 
 		// and evict
 		srv.apiEvictPod(ctx, pod.Namespace, pod.Name)
 	}
 
 	// loop until no critical pods found
-	looper.Loop(ctx, time.Second*10, func(ctx xhdl.Context) (exit bool) {
+	looper.LoopWithClock(ctx, srv.Clock, time.Second*10, func(ctx xhdl.Context) (exit bool) {
 		infof(ctx, "check if critical pods have exited")
 		stillAlive := own.CriticalPodsEvicted(ctx)
 
@@ -150,25 +705,52 @@ func (srv service) Teardown(ctx xhdl.Context) {
 
 }
 
-func (srv service) Release(ctx xhdl.Context) {
+// Release releases the session, and the lock and uncordons the node if it was
+// the last session. Without session the lock is only released if it is held
+// by a single session, so that we don't release the lock of another session.
+func (srv service) Release(ctx xhdl.Context, token kmutex.Token, session string) {
+	srv.release(ctx, token, session, false)
+}
+
+// release is Release, releasing all sessions if all is set
+func (srv service) release(ctx xhdl.Context, token kmutex.Token, session string, all bool) {
 
 	ns := srv.getNodeSet(ctx)
 	own := ns.OwnNode()
 
-	// validate lock ownership
-	owner := srv.km.CurrentOwner(ctx)
+	// with a stale token the lock and the node may belong to someone else
+	srv.checkToken(ctx, token)
+	srv.checkSession(ctx, session)
+
+	if h, held := srv.ownHolder(ctx); held && !all && session == "" && len(h.Sessions) > 1 {
+		ctx.Throw(fmt.Errorf("lock held by %d sessions, session required to release", len(h.Sessions)))
+	}
 
 	// we continue even if lock not held to ensure uncordoned
 	// node after release
-	if owner != srv.km.HolderIdentity {
+	if !srv.holdsLock(ctx) {
 		infof(ctx, "lock is currently not held!")
 	} else {
-		// release lock
-		srv.km.Release(ctx)
-		infof(ctx, "lock released")
+		// release lock, it may have been lost in the meantime
+		var stillHeld bool
+		err := xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+			stillHeld = srv.km.ReleaseSession(ctx, session)
+		})
+
+		if errors.Is(err, kmutex.ErrNotHolder) {
+			infof(ctx, "lock is currently not held: %v", err)
+		} else if err == nil && stillHeld {
+
+			// the node is still in use by the other sessions
+			infof(ctx, "session %s released, lock still held by other sessions", session)
+			return
+		} else {
+			ctx.Throw(err)
+			infof(ctx, "lock released")
 
-		// set lastRelease info label
-		own.SetLabel(ctx, labelLastRelease, getTSValue())
+			// set lastRelease info label
+			own.SetLabel(ctx, labelLastRelease, srv.getTSValue())
+		}
 	}
 
 	// uncordon
@@ -177,25 +759,100 @@ func (srv service) Release(ctx xhdl.Context) {
 
 }
 
-func (srv service) ReleaseDelayed(ctx xhdl.Context) {
+// ReleaseDelayed marks the node to release the lock on the next start of suss.
+// This releases all sessions, because they end with the reboot of the node.
+func (srv service) ReleaseDelayed(ctx xhdl.Context, token kmutex.Token, session string) {
 	ns := srv.getNodeSet(ctx)
 	own := ns.OwnNode()
 
+	srv.checkToken(ctx, token)
+	srv.checkSession(ctx, session)
 	infof(ctx, "set label %s node for delayed release", labelDelayedRelease)
 	own.SetLabel(ctx, labelDelayedRelease, "true")
 }
 
+// ForceRelease breaks the hold of another node, e.g. if the node is dead.
+// The node is uncordoned if cordoned by suss, and who broke the lock and why
+// is recorded on the lock and as an Event for the node. Nothing is changed if
+// the node doesn't hold the lock.
+// node is the name of the node, or the holder identity including the uid.
+// If node is empty, the current holder is used, if there is only one.
+// The node of a holder of another cluster is not touched, and there is no
+// node for a cluster operation.
+func (srv service) ForceRelease(ctx xhdl.Context, node, reason string) {
+	if reason == "" {
+		ctx.Throw(fmt.Errorf("reason required to force release"))
+	}
+
+	owners := srv.km.CurrentOwners(ctx)
+	identity := node
+	if node == "" {
+		if len(owners) != 1 {
+			ctx.Throw(fmt.Errorf("node required to force release, lock held by %d nodes", len(owners)))
+		}
+		identity = owners[0]
+	} else if !slices.Contains(owners, node) {
+		for _, owner := range owners {
+			if name, _ := holderNode(owner); name == node && srv.isLocalHolder(owner) {
+				identity = owner
+			}
+		}
+	}
+
+	// the node is not touched if it doesn't hold our lock, e.g. of another node group
+	holder, released := srv.km.ForceRelease(ctx, identity, reason)
+	if !released {
+		infof(ctx, "lock not held by %s", identity)
+		return
+	}
+	infof(ctx, "lock of %s (token %d) force released: %s", identity, holder.Token, reason)
+
+	// cluster operations don't run on a node
+	if isClusterIdentity(identity) {
+		return
+	}
+
+	if cluster := holderCluster(identity); cluster != "" && cluster != srv.ClusterName {
+		return
+	}
+
+	// the event is also recorded if the node no longer exists
+	name, uid := holderNode(identity)
+	nodeObj := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, UID: uid}}
+
+	// a recreated node is not touched, it has not been cordoned for this hold
+	n, found := srv.getNodeSet(ctx).FindNode(name)
+	if !found || (uid != "" && n.node.UID != uid) {
+		infof(ctx, "node %s not found", identity)
+	} else {
+		nodeObj = n.node
+
+		if n.CordonedBySuss() {
+			n.Cordoned(ctx, false)
+			infof(ctx, "node %s uncordoned", name)
+		}
+	}
+
+	message := fmt.Sprintf("lock held since %v force released by %s: %s", holder.AcquireTime.Time, srv.NodeName, reason)
+	srv.apiEmitEvent(ctx, nodeObj, "", v1.EventTypeWarning, "LockForceReleased", message)
+}
+
+// LockStatus returns the holders of the lock, and the nodes waiting for it
+func (srv service) LockStatus(ctx xhdl.Context) kmutex.Description {
+	return srv.km.Describe(ctx)
+}
+
 // getTSValue returns a timestamp based value for labels
-func getTSValue() string {
-	t := time.Now().UTC().Format(time.RFC3339)
+func (srv service) getTSValue() string {
+	t := srv.Clock.Now().UTC().Format(time.RFC3339)
 	t = strings.ReplaceAll(t, ":", "_")
 	return t
 }
 
 func (srv service) TestFail(ctx xhdl.Context) {
 	for i := 0; i < 5; i++ {
-		infof(ctx, "loop %d/%d (%v)", i+1, 5, time.Now())
-		time.Sleep(time.Second)
+		infof(ctx, "loop %d/%d (%v)", i+1, 5, srv.Clock.Now())
+		srv.Clock.Sleep(time.Second)
 	}
 
 	infof(ctx, "failing now")
@@ -0,0 +1,443 @@
+package suss
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gprossliner/xhdl"
+	"github.com/stretchr/testify/assert"
+	"github.com/world-direct/kmutex"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	clocktesting "k8s.io/utils/clock/testing"
+	"k8s.io/utils/ptr"
+)
+
+func testNode(name string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			UID:               types.UID(name + "-uid"),
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour)),
+		},
+		Status: v1.NodeStatus{Conditions: []v1.NodeCondition{{
+			Type:   v1.NodeReady,
+			Status: v1.ConditionTrue,
+		}}},
+	}
+}
+
+// newTestService returns the service of the node, storing the lock in backend
+func newTestService(k8s kubernetes.Interface, backend kmutex.Backend, clk *clocktesting.FakeClock, node string, options SussOptions) service {
+	options.NodeName = node
+	options.NodeUID = types.UID(node + "-uid")
+	options.LeaseNamespace = "suss"
+	options.K8s = k8s
+	options.LockBackend = backend
+	options.Clock = clk
+	return NewService(options).(service)
+}
+
+// command runs the command like the http handler, and returns its output
+func command(ctx context.Context, fn func(ctx xhdl.Context)) (string, error) {
+	var output bytes.Buffer
+	err := xhdl.RunContext(WithOutput(ctx, &output), fn)
+	return output.String(), err
+}
+
+// outputValue returns the value of "<key>=<value>" in the output of a command
+func outputValue(output, key string) string {
+	var value string
+	for _, line := range strings.Split(output, "\n") {
+		if v, found := strings.CutPrefix(line, key+"="); found {
+			value = v
+		}
+	}
+
+	return value
+}
+
+func TestSynchronize(t *testing.T) {
+
+	k8s := fake.NewSimpleClientset(testNode("node1"), testNode("node2"))
+	backend := kmutex.NewMemoryBackend()
+	clk := clocktesting.NewFakeClock(time.Now())
+
+	node1 := newTestService(k8s, backend, clk, "node1", SussOptions{})
+	node2 := newTestService(k8s, backend, clk, "node2", SussOptions{})
+	ctx := context.Background()
+
+	output, err := command(ctx, func(ctx xhdl.Context) { node1.Synchronize(ctx, "update", "test", "") })
+	assert.NoError(t, err)
+	assert.Equal(t, "1", outputValue(output, "token"))
+	session := outputValue(output, "session")
+	assert.NotEmpty(t, session)
+
+	// node2 waits for node1
+	done := make(chan string)
+	go func() {
+		output, err := command(ctx, func(ctx xhdl.Context) { node2.Synchronize(ctx, "update", "test", "") })
+		assert.NoError(t, err)
+		done <- output
+	}()
+
+	assert.Eventually(t, func() bool {
+		queue, err := waiters(ctx, node1)
+		return err == nil && len(queue) == 1 && queue[0].Identity == "node2/node2-uid"
+	}, time.Second, time.Millisecond)
+
+	_, err = command(ctx, func(ctx xhdl.Context) { node1.Release(ctx, 1, session) })
+	assert.NoError(t, err)
+
+	select {
+	case output := <-done:
+		assert.Contains(t, output, "waiting for lock at position 1 of 1")
+		assert.Equal(t, "2", outputValue(output, "token"))
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "node2 not synchronized after release of node1")
+	}
+
+	// the session of node1 is gone with its hold
+	_, err = command(ctx, func(ctx xhdl.Context) { node1.Teardown(ctx, 0, session) })
+	assert.Error(t, err)
+}
+
+func TestSynchronizeResumesSession(t *testing.T) {
+
+	k8s := fake.NewSimpleClientset(testNode("node1"))
+	clk := clocktesting.NewFakeClock(time.Now())
+	node1 := newTestService(k8s, kmutex.NewMemoryBackend(), clk, "node1", SussOptions{})
+	ctx := context.Background()
+
+	// the call is retried by the script, e.g. after the connection failed
+	for i := 0; i < 2; i++ {
+		output, err := command(ctx, func(ctx xhdl.Context) { node1.Synchronize(ctx, "update", "test", "s1") })
+		assert.NoError(t, err)
+		assert.Equal(t, "1", outputValue(output, "token"))
+		assert.Equal(t, "s1", outputValue(output, "session"))
+	}
+
+	// so the session is the only one, and its release releases the lock
+	_, err := command(ctx, func(ctx xhdl.Context) { node1.Release(ctx, 1, "s1") })
+	assert.NoError(t, err)
+
+	err = xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		assert.Empty(t, node1.km.CurrentOwners(ctx))
+	})
+	assert.NoError(t, err)
+}
+
+func TestOwnOverdueHoldIsEscalated(t *testing.T) {
+
+	k8s := fake.NewSimpleClientset(testNode("node1"))
+	clk := clocktesting.NewFakeClock(time.Now())
+	node1 := newTestService(k8s, kmutex.NewMemoryBackend(), clk, "node1", SussOptions{MaxHoldDuration: time.Hour})
+	ctx := context.Background()
+
+	_, err := command(ctx, func(ctx xhdl.Context) { node1.Synchronize(ctx, "update", "test", "") })
+	assert.NoError(t, err)
+
+	// no node waits for the lock, the holder itself escalates
+	assert.Eventually(t, clk.HasWaiters, time.Second, time.Millisecond)
+	clk.Step(2 * time.Hour)
+
+	assert.Eventually(t, func() bool {
+		events, err := k8s.CoreV1().Events("suss").List(ctx, metav1.ListOptions{})
+		return err == nil && len(events.Items) == 1 && events.Items[0].Reason == "LockHoldOverdue"
+	}, time.Second, time.Millisecond)
+}
+
+func TestClusterNameTakesOverOwnHold(t *testing.T) {
+
+	k8s := fake.NewSimpleClientset(testNode("node1"))
+	backend := kmutex.NewMemoryBackend()
+	clk := clocktesting.NewFakeClock(time.Now())
+	ctx := context.Background()
+
+	_, err := command(ctx, func(ctx xhdl.Context) {
+		newTestService(k8s, backend, clk, "node1", SussOptions{}).Synchronize(ctx, "update", "test", "")
+	})
+	assert.NoError(t, err)
+
+	// suss is restarted with a cluster name during the update
+	node1 := newTestService(k8s, backend, clk, "node1", SussOptions{ClusterName: "a"})
+	_, err = command(ctx, node1.Start)
+	assert.NoError(t, err)
+
+	err = xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		assert.Equal(t, []string{"node1/node1-uid@a"}, node1.km.CurrentOwners(ctx))
+		assert.True(t, node1.km.CheckToken(ctx, 1))
+	})
+	assert.NoError(t, err)
+}
+
+func TestTakeOverHoldOfPreviousVersion(t *testing.T) {
+
+	// the Lease as held by a version of suss without uids and acquire times
+	transitions := int32(3)
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "sync", Namespace: "suss"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:   ptr.To("node1"),
+			LeaseTransitions: &transitions,
+		},
+	}
+
+	k8s := fake.NewSimpleClientset(testNode("node1"), lease)
+	clk := clocktesting.NewFakeClock(time.Now())
+	ctx := context.Background()
+
+	node1 := newTestService(k8s, kmutex.NewLeaseBackend(k8s, "suss", "sync"), clk, "node1", SussOptions{})
+	_, err := command(ctx, node1.Start)
+	assert.NoError(t, err)
+
+	err = xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		assert.Equal(t, []string{"node1/node1-uid"}, node1.km.CurrentOwners(ctx))
+		assert.True(t, node1.km.CheckToken(ctx, 3))
+	})
+	assert.NoError(t, err)
+}
+
+func TestForceReleaseOfOtherGroupKeepsNode(t *testing.T) {
+
+	storageNode := testNode("node2")
+	storageNode.Labels = map[string]string{labelCordoned: "true"}
+	storageNode.Spec.Unschedulable = true
+	k8s := fake.NewSimpleClientset(testNode("node1"), storageNode)
+	workers, storage := kmutex.NewMemoryBackend(), kmutex.NewMemoryBackend()
+	clk := clocktesting.NewFakeClock(time.Now())
+	ctx := context.Background()
+
+	// node2 is a storage node in the middle of its update
+	node1 := newTestService(k8s, workers, clk, "node1", SussOptions{})
+	node2 := newTestService(k8s, storage, clk, "node2", SussOptions{})
+	_, err := command(ctx, func(ctx xhdl.Context) { node2.Synchronize(ctx, "update", "test", "") })
+	assert.NoError(t, err)
+
+	// the lock of the workers is not held by node2, so nothing is changed
+	_, err = command(ctx, func(ctx xhdl.Context) { node1.ForceRelease(ctx, "node2", "test") })
+	assert.NoError(t, err)
+
+	n, err := k8s.CoreV1().Nodes().Get(ctx, "node2", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, n.Spec.Unschedulable)
+
+	events, err := k8s.CoreV1().Events("suss").List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, events.Items)
+
+	err = xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		assert.Equal(t, []string{"node2/node2-uid"}, node2.km.CurrentOwners(ctx))
+	})
+	assert.NoError(t, err)
+}
+
+func TestRecoverStaleHolders(t *testing.T) {
+
+	clk := clocktesting.NewFakeClock(time.Now())
+	notReady := func(since time.Duration, labels map[string]string) *v1.Node {
+		n := testNode("node2")
+		n.Labels = labels
+		n.Status.Conditions[0].Status = v1.ConditionFalse
+		n.Status.Conditions[0].LastTransitionTime = metav1.NewTime(clk.Now().Add(-since))
+		return n
+	}
+
+	recreated := testNode("node2")
+	recreated.UID = "node2-uid2"
+
+	tests := map[string]struct {
+		node   *v1.Node
+		owners []string
+	}{
+		"Ready":                         {testNode("node2"), []string{"node2/node2-uid"}},
+		"deleted":                       {nil, nil},
+		"recreated":                     {recreated, nil},
+		"NotReady beyond the threshold": {notReady(10*time.Minute, nil), nil},
+		"NotReady within the threshold": {notReady(time.Minute, nil), []string{"node2/node2-uid"}},
+		"marked for delayed release":    {notReady(10*time.Minute, map[string]string{labelDelayedRelease: "true"}), []string{"node2/node2-uid"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			objects := []runtime.Object{testNode("node1")}
+			if tc.node != nil {
+				objects = append(objects, tc.node)
+			}
+
+			k8s := fake.NewSimpleClientset(objects...)
+			backend := kmutex.NewMemoryBackend()
+			options := SussOptions{StaleHolderThreshold: 5 * time.Minute}
+			node1 := newTestService(k8s, backend, clk, "node1", options)
+			node2 := newTestService(k8s, backend, clk, "node2", options)
+
+			err := xhdl.RunContext(context.Background(), func(ctx xhdl.Context) {
+				node2.km.TryAcquire(ctx, kmutex.HolderInfo{})
+
+				node1.recoverStaleHolders(ctx, node1.km.CurrentOwners(ctx))
+				assert.Equal(t, tc.owners, node1.km.CurrentOwners(ctx))
+			})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestForceReleaseClusterOperation(t *testing.T) {
+
+	k8s := fake.NewSimpleClientset(testNode("node1"))
+	clk := clocktesting.NewFakeClock(time.Now())
+	node1 := newTestService(k8s, kmutex.NewMemoryBackend(), clk, "node1", SussOptions{})
+	ctx := context.Background()
+
+	_, err := command(ctx, func(ctx xhdl.Context) { node1.SynchronizeCluster(ctx, "defrag", "etcd", "test") })
+	assert.NoError(t, err)
+
+	// the only holder is released, without a node to uncordon or to record an Event for
+	_, err = command(ctx, func(ctx xhdl.Context) { node1.ForceRelease(ctx, "", "test") })
+	assert.NoError(t, err)
+
+	events, err := k8s.CoreV1().Events("suss").List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, events.Items)
+
+	err = xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		assert.Empty(t, node1.km.CurrentOwners(ctx))
+	})
+	assert.NoError(t, err)
+}
+
+func TestUnhealthyClusterKeepsPlaceInQueue(t *testing.T) {
+
+	broken := testNode("node3")
+	broken.Status.Conditions[0].Status = v1.ConditionFalse
+	k8s := fake.NewSimpleClientset(testNode("node1"), testNode("node2"), broken)
+	backend := kmutex.NewMemoryBackend()
+	clk := clocktesting.NewFakeClock(time.Now())
+
+	node1 := newTestService(k8s, backend, clk, "node1", SussOptions{ClusterHealthCheck: true})
+	node2 := newTestService(k8s, backend, clk, "node2", SussOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done1, done2 := make(chan string), make(chan error)
+	go func() {
+		output, err := command(ctx, func(ctx xhdl.Context) { node1.Synchronize(ctx, "update", "test", "") })
+		assert.NoError(t, err)
+		done1 <- output
+	}()
+
+	assert.Eventually(t, func() bool {
+		queue, err := waiters(ctx, node1)
+		return err == nil && len(queue) == 1
+	}, time.Second, time.Millisecond)
+
+	// node2 is queued after node1, which waits for node3
+	go func() {
+		_, err := command(ctx, func(ctx xhdl.Context) { node2.Synchronize(ctx, "update", "test", "") })
+		done2 <- err
+	}()
+
+	assert.Eventually(t, func() bool {
+		queue, err := waiters(ctx, node1)
+		return err == nil && len(queue) == 2 && queue[1].Identity == "node2/node2-uid"
+	}, time.Second, time.Millisecond)
+
+	_, err := k8s.CoreV1().Nodes().Update(ctx, testNode("node3"), metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	clk.Step(30 * time.Second)
+
+	select {
+	case output := <-done1:
+		assert.Contains(t, output, "waiting at the head of the queue: cluster unhealthy: node node3 is NotReady")
+		assert.Equal(t, "1", outputValue(output, "token"))
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "node1 not synchronized after node3 became Ready")
+	}
+
+	cancel()
+	assert.ErrorIs(t, <-done2, context.Canceled)
+}
+
+func TestSynchronizeClusterLocksAllGroups(t *testing.T) {
+
+	k8s := fake.NewSimpleClientset(testNode("node1"), testNode("node2"))
+	workers, storage := kmutex.NewMemoryBackend(), kmutex.NewMemoryBackend()
+	clk := clocktesting.NewFakeClock(time.Now())
+	ctx := context.Background()
+
+	// node1 is a worker, node2 a storage node
+	all := []kmutex.Backend{workers, storage}
+	node1 := newTestService(k8s, workers, clk, "node1", SussOptions{ClusterLockBackends: all})
+	node2 := newTestService(k8s, storage, clk, "node2", SussOptions{ClusterLockBackends: all})
+
+	output, err := command(ctx, func(ctx xhdl.Context) { node2.Synchronize(ctx, "update", "test", "") })
+	assert.NoError(t, err)
+	session := outputValue(output, "session")
+
+	// the operation started on node1 waits for node2 of the other group
+	done := make(chan string)
+	go func() {
+		output, err := command(ctx, func(ctx xhdl.Context) { node1.SynchronizeCluster(ctx, "defrag", "etcd", "test") })
+		assert.NoError(t, err)
+		done <- output
+	}()
+
+	assert.Eventually(t, func() bool {
+		queue, err := waiters(ctx, node2)
+		return err == nil && len(queue) == 1 && queue[0].Identity == "cluster:defrag"
+	}, time.Second, time.Millisecond)
+
+	_, err = command(ctx, func(ctx xhdl.Context) { node2.Release(ctx, 0, session) })
+	assert.NoError(t, err)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "cluster operation not synchronized after release of node2")
+	}
+
+	// and holds the locks of both groups
+	err = xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		assert.Equal(t, []string{"cluster:defrag"}, node1.km.CurrentOwners(ctx))
+		assert.Equal(t, []string{"cluster:defrag"}, node2.km.CurrentOwners(ctx))
+	})
+	assert.NoError(t, err)
+}
+
+func TestClusterSessionDoesntExpire(t *testing.T) {
+
+	k8s := fake.NewSimpleClientset(testNode("node1"))
+	clk := clocktesting.NewFakeClock(time.Now())
+	ctx := context.Background()
+
+	node1 := newTestService(k8s, kmutex.NewMemoryBackend(), clk, "node1", SussOptions{SessionTimeout: time.Minute})
+	_, err := command(ctx, func(ctx xhdl.Context) { node1.SynchronizeCluster(ctx, "defrag", "etcd", "test") })
+	assert.NoError(t, err)
+
+	// there is no command to refresh the session of the operation
+	clk.Step(time.Hour)
+
+	err = xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		_, acquired := node1.km.TryAcquire(ctx, kmutex.HolderInfo{})
+		assert.False(t, acquired)
+		assert.Equal(t, []string{"cluster:defrag"}, node1.km.CurrentOwners(ctx))
+	})
+	assert.NoError(t, err)
+}
+
+// waiters returns the waiters of the lock of the service
+func waiters(ctx context.Context, srv service) (waiters []kmutex.Ticket, err error) {
+	err = xhdl.RunContext(ctx, func(ctx xhdl.Context) {
+		waiters = srv.km.Describe(ctx).Waiters
+	})
+
+	return
+}
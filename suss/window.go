@@ -0,0 +1,266 @@
+package suss
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gprossliner/xhdl"
+)
+
+const (
+	// WindowPolicyWait lets Synchronize wait for the next maintenance window
+	WindowPolicyWait = "wait"
+
+	// WindowPolicyRefuse lets Synchronize fail outside of a maintenance window
+	WindowPolicyRefuse = "refuse"
+)
+
+// ErrOutsideMaintenanceWindow is returned by Synchronize with WindowPolicyRefuse,
+// if the update doesn't fit into a maintenance window
+var ErrOutsideMaintenanceWindow = errors.New("outside of maintenance window")
+
+// errWindowMissed aborts waiting for the lock, if the update no
+// longer fits into the maintenance window
+var errWindowMissed = errors.New("maintenance window missed")
+
+// MaintenanceWindow is a time range on some weekdays, in which nodes
+// may be updated. A window ending before its start ends on the next day.
+type MaintenanceWindow struct {
+	// Weekdays the window starts on, all days if empty
+	Weekdays []time.Weekday
+
+	// Start and End are the time of day, as offset from midnight
+	Start, End time.Duration
+
+	// Location is the time zone of the window
+	Location *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseMaintenanceWindows parses windows separated by ";", each in the form
+// "<days> <hh:mm>-<hh:mm> [<time zone>]", e.g. "Mon-Fri 01:00-05:00 Europe/Vienna".
+// days are weekdays or ranges of them separated by ",", or "*" for all days.
+// The time zone defaults to the local time zone.
+func ParseMaintenanceWindows(s string) ([]MaintenanceWindow, error) {
+	var windows []MaintenanceWindow
+	for _, ws := range strings.Split(s, ";") {
+		if strings.TrimSpace(ws) == "" {
+			continue
+		}
+
+		w, err := parseMaintenanceWindow(ws)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q: %w", strings.TrimSpace(ws), err)
+		}
+
+		windows = append(windows, w)
+	}
+
+	return windows, nil
+}
+
+func parseMaintenanceWindow(s string) (MaintenanceWindow, error) {
+	w := MaintenanceWindow{Location: time.Local}
+
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return w, fmt.Errorf("expected \"<days> <hh:mm>-<hh:mm> [<time zone>]\"")
+	}
+
+	if fields[0] != "*" {
+		for _, r := range strings.Split(fields[0], ",") {
+			from, to, isRange := strings.Cut(r, "-")
+			first, ok := weekdays[strings.ToLower(from)]
+			if !ok {
+				return w, fmt.Errorf("invalid weekday %q", from)
+			}
+
+			last := first
+			if isRange {
+				if last, ok = weekdays[strings.ToLower(to)]; !ok {
+					return w, fmt.Errorf("invalid weekday %q", to)
+				}
+			}
+
+			for d := first; ; d = (d + 1) % 7 {
+				w.Weekdays = append(w.Weekdays, d)
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return w, fmt.Errorf("invalid time range %q", fields[1])
+	}
+
+	var err error
+	if w.Start, err = parseTimeOfDay(start); err != nil {
+		return w, err
+	}
+
+	if w.End, err = parseTimeOfDay(end); err != nil {
+		return w, err
+	}
+
+	if len(fields) == 3 {
+		if w.Location, err = time.LoadLocation(fields[2]); err != nil {
+			return w, err
+		}
+	}
+
+	return w, nil
+}
+
+// parseTimeOfDay parses "hh:mm" as offset from midnight, "24:00" is the end of the day
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// String returns the window in the form parsed by ParseMaintenanceWindows
+func (w MaintenanceWindow) String() string {
+	days := "*"
+	if len(w.Weekdays) > 0 {
+		var names []string
+		for _, d := range w.Weekdays {
+			names = append(names, d.String()[:3])
+		}
+		days = strings.Join(names, ",")
+	}
+
+	tod := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+
+	return fmt.Sprintf("%s %s-%s %s", days, tod(w.Start), tod(w.End), w.Location)
+}
+
+// occurrence returns the start and end of the window starting on the day of t,
+// and false if the window doesn't start on this weekday
+func (w MaintenanceWindow) occurrence(t time.Time) (start, end time.Time, ok bool) {
+	t = t.In(w.Location)
+	if len(w.Weekdays) > 0 && !slices.Contains(w.Weekdays, t.Weekday()) {
+		return start, end, false
+	}
+
+	// the times are wall clock times, so they are set by time.Date, which keeps
+	// them on daylight saving days, unlike adding the offset to midnight
+	y, m, d := t.Date()
+	at := func(day int, tod time.Duration) time.Time {
+		return time.Date(y, m, day, int(tod/time.Hour), int(tod%time.Hour/time.Minute), 0, 0, w.Location)
+	}
+
+	start = at(d, w.Start)
+	if w.End <= w.Start {
+		end = at(d+1, w.End)
+	} else {
+		end = at(d, w.End)
+	}
+
+	return start, end, true
+}
+
+// nextWindow returns the earliest time from now on, at which an update taking
+// duration fits into one of the windows, and the end of this window.
+// It returns false if the update doesn't fit into any of them.
+func nextWindow(windows []MaintenanceWindow, now time.Time, duration time.Duration) (start, end time.Time, ok bool) {
+	for _, w := range windows {
+		// a window started yesterday may still be open, and every weekday is within a week
+		for day := -1; day <= 7; day++ {
+			s, e, found := w.occurrence(now.In(w.Location).AddDate(0, 0, day))
+			if !found || e.Before(now) {
+				continue
+			}
+
+			if s.Before(now) {
+				s = now
+			}
+
+			if s.Add(duration).After(e) {
+				continue
+			}
+
+			if !ok || s.Before(start) {
+				start, end, ok = s, e, true
+			}
+		}
+	}
+
+	return
+}
+
+// updateDuration returns the expected duration of an update
+func (srv service) updateDuration() time.Duration {
+	if srv.UpdateDuration > 0 {
+		return srv.UpdateDuration
+	}
+
+	return srv.MaxHoldDuration
+}
+
+// inMaintenanceWindow returns true if an update started now ends within a maintenance window
+func (srv service) inMaintenanceWindow() bool {
+	if len(srv.MaintenanceWindows) == 0 {
+		return true
+	}
+
+	now := srv.Clock.Now()
+	start, _, ok := nextWindow(srv.MaintenanceWindows, now, srv.updateDuration())
+	return ok && !start.After(now)
+}
+
+// waitForMaintenanceWindow returns when an update started now ends within a
+// maintenance window. Outside of a window it waits for the next one, or fails
+// with ErrOutsideMaintenanceWindow if the WindowPolicy is WindowPolicyRefuse.
+func (srv service) waitForMaintenanceWindow(ctx xhdl.Context) {
+	if len(srv.MaintenanceWindows) == 0 {
+		return
+	}
+
+	for {
+		now := srv.Clock.Now()
+		start, end, ok := nextWindow(srv.MaintenanceWindows, now, srv.updateDuration())
+		if !ok {
+			ctx.Throw(fmt.Errorf("%w: an update of %v doesn't fit into any maintenance window", ErrOutsideMaintenanceWindow, srv.updateDuration()))
+		}
+
+		if !start.After(now) {
+			infof(ctx, "in maintenance window until %s", end.Format(time.RFC3339))
+			return
+		}
+
+		if srv.WindowPolicy == WindowPolicyRefuse {
+			ctx.Throw(fmt.Errorf("%w, next window starts at %s", ErrOutsideMaintenanceWindow, start.Format(time.RFC3339)))
+		}
+
+		outputf(ctx, "waiting for maintenance window at %s", start.Format(time.RFC3339))
+		srv.sleep(ctx, start.Sub(now))
+	}
+}
+
+// checkMaintenanceWindow aborts waiting for the lock with errWindowMissed, if an
+// update started now would no longer end within the maintenance window
+func (srv service) checkMaintenanceWindow(ctx xhdl.Context) {
+	if !srv.inMaintenanceWindow() {
+		ctx.Throw(errWindowMissed)
+	}
+}
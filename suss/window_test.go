@@ -0,0 +1,179 @@
+package suss
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMaintenanceWindows(t *testing.T) {
+
+	vienna, err := time.LoadLocation("Europe/Vienna")
+	assert.NoError(t, err)
+
+	valid := map[string]struct {
+		s       string
+		windows []MaintenanceWindow
+	}{
+		"empty": {"", nil},
+		"range": {"Mon-Fri 01:00-05:00 Europe/Vienna", []MaintenanceWindow{{
+			Weekdays: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+			Start:    time.Hour,
+			End:      5 * time.Hour,
+			Location: vienna,
+		}}},
+		"range over the weekend": {"fri-mon 22:30-24:00 UTC", []MaintenanceWindow{{
+			Weekdays: []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday},
+			Start:    22*time.Hour + 30*time.Minute,
+			End:      24 * time.Hour,
+			Location: time.UTC,
+		}}},
+		"all days in local time": {"* 22:00-02:00", []MaintenanceWindow{{
+			Start:    22 * time.Hour,
+			End:      2 * time.Hour,
+			Location: time.Local,
+		}}},
+		"multiple": {"Sat 01:00-05:00 UTC; Sun,Wed 03:00-04:00 UTC;", []MaintenanceWindow{{
+			Weekdays: []time.Weekday{time.Saturday},
+			Start:    time.Hour,
+			End:      5 * time.Hour,
+			Location: time.UTC,
+		}, {
+			Weekdays: []time.Weekday{time.Sunday, time.Wednesday},
+			Start:    3 * time.Hour,
+			End:      4 * time.Hour,
+			Location: time.UTC,
+		}}},
+	}
+
+	for name, tc := range valid {
+		t.Run(name, func(t *testing.T) {
+			windows, err := ParseMaintenanceWindows(tc.s)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.windows, windows)
+		})
+	}
+
+	invalid := map[string]string{
+		"weekday":      "Mon-Fry 01:00-05:00",
+		"no range":     "Mon 01:00",
+		"hour":         "Mon 01:00-25:00",
+		"minute":       "Mon 01:60-05:00",
+		"time zone":    "Mon 01:00-05:00 Europe/Nowhere",
+		"extra fields": "Mon 01:00-05:00 UTC now",
+	}
+
+	for name, s := range invalid {
+		t.Run("invalid "+name, func(t *testing.T) {
+			_, err := ParseMaintenanceWindows(s)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNextWindow(t *testing.T) {
+
+	vienna, err := time.LoadLocation("Europe/Vienna")
+	assert.NoError(t, err)
+
+	at := func(loc *time.Location, y int, m time.Month, d, h, min int) time.Time {
+		return time.Date(y, m, d, h, min, 0, 0, loc)
+	}
+
+	tests := map[string]struct {
+		windows    string
+		now        time.Time
+		duration   time.Duration
+		start, end time.Time
+		ok         bool
+	}{
+		"before the window": {
+			"* 01:00-05:00 UTC", at(time.UTC, 2024, 5, 1, 0, 0), time.Hour,
+			at(time.UTC, 2024, 5, 1, 1, 0), at(time.UTC, 2024, 5, 1, 5, 0), true,
+		},
+		"in the window": {
+			"* 01:00-05:00 UTC", at(time.UTC, 2024, 5, 1, 2, 0), time.Hour,
+			at(time.UTC, 2024, 5, 1, 2, 0), at(time.UTC, 2024, 5, 1, 5, 0), true,
+		},
+		"update ends with the window": {
+			"* 01:00-05:00 UTC", at(time.UTC, 2024, 5, 1, 4, 0), time.Hour,
+			at(time.UTC, 2024, 5, 1, 4, 0), at(time.UTC, 2024, 5, 1, 5, 0), true,
+		},
+		"update ends after the window": {
+			"* 01:00-05:00 UTC", at(time.UTC, 2024, 5, 1, 4, 0), time.Hour + time.Minute,
+			at(time.UTC, 2024, 5, 2, 1, 0), at(time.UTC, 2024, 5, 2, 5, 0), true,
+		},
+		"update longer than the window": {
+			"* 01:00-05:00 UTC", at(time.UTC, 2024, 5, 1, 0, 0), 5 * time.Hour,
+			time.Time{}, time.Time{}, false,
+		},
+		"next weekday": {
+			// 2024-05-01 is a Wednesday
+			"Sat 01:00-05:00 UTC", at(time.UTC, 2024, 5, 1, 2, 0), time.Hour,
+			at(time.UTC, 2024, 5, 4, 1, 0), at(time.UTC, 2024, 5, 4, 5, 0), true,
+		},
+		"earliest of multiple windows": {
+			"Sat 01:00-05:00 UTC; Thu 03:00-04:00 UTC", at(time.UTC, 2024, 5, 1, 2, 0), time.Hour,
+			at(time.UTC, 2024, 5, 2, 3, 0), at(time.UTC, 2024, 5, 2, 4, 0), true,
+		},
+		"crossing midnight, before midnight": {
+			"* 22:00-02:00 UTC", at(time.UTC, 2024, 5, 1, 23, 0), time.Hour,
+			at(time.UTC, 2024, 5, 1, 23, 0), at(time.UTC, 2024, 5, 2, 2, 0), true,
+		},
+		"crossing midnight, started yesterday": {
+			"* 22:00-02:00 UTC", at(time.UTC, 2024, 5, 2, 1, 0), time.Hour,
+			at(time.UTC, 2024, 5, 2, 1, 0), at(time.UTC, 2024, 5, 2, 2, 0), true,
+		},
+		"crossing midnight, started yesterday on its weekday": {
+			// 2024-05-04 is a Saturday, the window of Friday is still open
+			"Fri 22:00-02:00 UTC", at(time.UTC, 2024, 5, 4, 1, 0), 30 * time.Minute,
+			at(time.UTC, 2024, 5, 4, 1, 0), at(time.UTC, 2024, 5, 4, 2, 0), true,
+		},
+		"crossing midnight, too late for the update": {
+			"* 22:00-02:00 UTC", at(time.UTC, 2024, 5, 2, 1, 0), 2 * time.Hour,
+			at(time.UTC, 2024, 5, 2, 22, 0), at(time.UTC, 2024, 5, 3, 2, 0), true,
+		},
+		"until the end of the day": {
+			"* 22:00-24:00 UTC", at(time.UTC, 2024, 5, 1, 12, 0), time.Hour,
+			at(time.UTC, 2024, 5, 1, 22, 0), at(time.UTC, 2024, 5, 2, 0, 0), true,
+		},
+		"time zone": {
+			// 07:00 in Vienna
+			"* 01:00-05:00 Europe/Vienna", at(time.UTC, 2024, 5, 1, 5, 0), time.Hour,
+			at(vienna, 2024, 5, 2, 1, 0), at(vienna, 2024, 5, 2, 5, 0), true,
+		},
+		"start of daylight saving time": {
+			// the clocks are set from 02:00 to 03:00 on 2024-03-31
+			"* 04:00-06:00 Europe/Vienna", at(vienna, 2024, 3, 31, 0, 30), time.Hour,
+			at(vienna, 2024, 3, 31, 4, 0), at(vienna, 2024, 3, 31, 6, 0), true,
+		},
+		"end of daylight saving time": {
+			// the clocks are set from 03:00 to 02:00 on 2024-10-27
+			"* 04:00-06:00 Europe/Vienna", at(vienna, 2024, 10, 27, 0, 30), time.Hour,
+			at(vienna, 2024, 10, 27, 4, 0), at(vienna, 2024, 10, 27, 6, 0), true,
+		},
+		"daylight saving time change within the window": {
+			// the window is an hour shorter, 01:00 CET to 05:00 CEST
+			"* 01:00-05:00 Europe/Vienna", at(vienna, 2024, 3, 31, 0, 30), 3*time.Hour + time.Minute,
+			at(vienna, 2024, 4, 1, 1, 0), at(vienna, 2024, 4, 1, 5, 0), true,
+		},
+		"crossing midnight into daylight saving time": {
+			"Sat 22:00-04:00 Europe/Vienna", at(vienna, 2024, 3, 30, 12, 0), time.Hour,
+			at(vienna, 2024, 3, 30, 22, 0), at(vienna, 2024, 3, 31, 4, 0), true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			windows, err := ParseMaintenanceWindows(tc.windows)
+			assert.NoError(t, err)
+
+			start, end, ok := nextWindow(windows, tc.now, tc.duration)
+			assert.Equal(t, tc.ok, ok)
+			assert.True(t, tc.start.Equal(start), "start %s, expected %s", start, tc.start)
+			assert.True(t, tc.end.Equal(end), "end %s, expected %s", end, tc.end)
+		})
+	}
+}
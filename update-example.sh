@@ -52,11 +52,15 @@ fi
 trap 'echo "stopping logstream";kill $log_pid' SIGINT SIGTERM EXIT
 curl --silent $SUSS_URL/logstream & log_pid=$!
 
-# synchronize with other hosts
-suss synchronize
+# synchronize with other hosts, and keep the fencing token of the lock. The session
+# is passed, so a retried call resumes it instead of adding another session
+session=$(od -An -N8 -tx1 /dev/urandom | tr -d ' \n')
+synchronize_output=$(suss "synchronize?reason=os-update&client=$(basename "$0")&session=$session") || exit 1
+echo "$synchronize_output"
+token=$(echo "$synchronize_output" | sed -n 's/^token=//p')
 
 # teardown critical workload
-suss teardown
+suss "teardown?token=$token&session=$session"
 
 # and finally run update
 # https://dnf.readthedocs.io/en/latest/command_ref.html#upgrade-command-label
@@ -64,7 +68,7 @@ yum update -y
 rc=$?
 if [[ "$rc" != "0" ]]; then
     echo "dnf update failed, releasing lock"
-    suss release
+    suss "release?token=$token&session=$session"
     exit 1
 fi
 
@@ -74,12 +78,12 @@ needs-restarting -r
 rc=$?
 if [[ "$rc" == "0" ]]; then
     echo "No reboot required, releasing lock"
-    suss release
+    suss "release?token=$token&session=$session"
     exit 0
 fi
 
 # need reboot, release delayed
-suss releasedelayed
+suss "releasedelayed?token=$token&session=$session"
 
 # and finally reboot, use -t so that script has exit code 0
 shutdown -t 1 -r